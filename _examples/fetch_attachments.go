@@ -42,6 +42,7 @@ func main() {
 	srv, err := gmail.NewService(f, *subject)
 	chk("Initialize service", err)
 	srv.DefaultQ = "is:unread from:m-pesastatements@safaricom.co.ke"
+	srv.CaptureHeaders = []string{"From", "Date", "Subject", "Message-ID"}
 
 	attachments, err := srv.ProcessPDFAttachments(true)
 	if attachments != nil {
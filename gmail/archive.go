@@ -0,0 +1,108 @@
+package gmail
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// WriteTarGz streams the attachments into a gzip compressed tar written to w.
+// Each entry is named after the attachment's Filename and carries the message
+// date as its modification time, or the current time when it isn't known
+func (at ProcessedAttachments) WriteTarGz(w io.Writer) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	for _, a := range at {
+		if a.Body == nil {
+			// written to a sink that can't be read back
+			continue
+		}
+		body, size, err := sizedBody(a.Body)
+		if err != nil {
+			return err
+		}
+
+		modTime := a.Date
+		if modTime.IsZero() {
+			modTime = clockNow()
+		}
+		hdr := &tar.Header{
+			Name:    filepath.ToSlash(a.Filename),
+			Mode:    0600,
+			Size:    size,
+			ModTime: modTime,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, body); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// sizedBody returns a reader over the whole of body along with its size.
+// Seekable bodies are rewound, anything else is buffered in memory
+func sizedBody(body io.Reader) (io.Reader, int64, error) {
+	if seeker, ok := body.(io.Seeker); ok {
+		size, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, 0, err
+		}
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return nil, 0, err
+		}
+		return body, size, nil
+	}
+	if buf, ok := body.(*bytes.Buffer); ok {
+		return buf, int64(buf.Len()), nil
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(data), int64(len(data)), nil
+}
+
+// StreamZip writes the attachments a run would process into a zip archive on
+// w, e.g. the response of an HTTP handler, without marking messages as read.
+// Each attachment is decoded straight into its entry, so neither the
+// attachments nor the archive are held in memory or on disk. Like in a run,
+// the writer generators are replaced and LastRunStore is neither consulted
+// nor updated. The run's Stats are available afterwards
+func (srv *Service) StreamZip(ctx context.Context, w io.Writer) error {
+	zw := zip.NewWriter(w)
+
+	z := *srv
+	z.AttachmentWriterGenerator = func(att *ProcessedAttachment) (io.Writer, error) {
+		hdr := &zip.FileHeader{
+			Name:     filepath.ToSlash(att.Filename),
+			Method:   zip.Deflate,
+			Modified: att.Date,
+		}
+		return zw.CreateHeader(hdr)
+	}
+	// entries must be written one after the other
+	z.WriteConcurrency = 0
+	z.StreamThreshold = 1
+	z.LastRunStore = nil
+
+	_, err := z.ProcessPDFAttachmentsContext(ctx, false)
+	srv.Stats = z.Stats
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
@@ -0,0 +1,122 @@
+package gmail
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamZip(t *testing.T) {
+	date := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+	fake := newFakeGmail(pdfMessage("m1", date, "a.pdf", "b.pdf"), pdfMessage("m2", date, "c.pdf"))
+	defer fake.Close()
+	files := &memFiles{}
+	srv := fake.service(t, files)
+
+	handler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/zip")
+		if err := srv.StreamZip(r.Context(), w); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer handler.Close()
+
+	res, err := http.Get(handler.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"a.pdf-m1-0.pdf": "%PDF-1.4 m1/a.pdf",
+		"b.pdf-m1-1.pdf": "%PDF-1.4 m1/b.pdf",
+		"c.pdf-m2-0.pdf": "%PDF-1.4 m2/c.pdf",
+	}
+	if len(zr.File) != len(want) {
+		t.Errorf("got %d entries, want %d", len(zr.File), len(want))
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want[f.Name] {
+			t.Errorf("entry %s holds %q, want %q", f.Name, got, want[f.Name])
+		}
+	}
+	if len(files.names()) > 0 {
+		t.Errorf("wrote %v outside the zip", files.names())
+	}
+	if marked := fake.markedRead(); len(marked) > 0 {
+		t.Errorf("marked %v as read", marked)
+	}
+}
+
+func TestWriteTarGz(t *testing.T) {
+	now := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	_, restore := fakeClock(now)
+	defer restore()
+	date := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+
+	atts := ProcessedAttachments{
+		{Filename: "m1/a.pdf", Date: date, Body: bytes.NewBufferString("%PDF-1.4 a")},
+		{Filename: "b.pdf", Date: date, Body: strings.NewReader("%PDF-1.4 b")},
+		{Filename: "undated.pdf", Body: ioutil.NopCloser(strings.NewReader("%PDF-1.4 undated"))},
+		{Filename: "uploaded.pdf", Date: date},
+	}
+	var archive bytes.Buffer
+	if err := atts.WriteTarGz(&archive); err != nil {
+		t.Fatal(err)
+	}
+
+	gr, err := gzip.NewReader(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	var entries []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, fmt.Sprintf("%s %q %s", hdr.Name, content, hdr.ModTime.UTC().Format(time.RFC3339)))
+	}
+	want := []string{
+		`m1/a.pdf "%PDF-1.4 a" 2020-01-02T10:00:00Z`,
+		`b.pdf "%PDF-1.4 b" 2020-01-02T10:00:00Z`,
+		`undated.pdf "%PDF-1.4 undated" 2021-03-04T05:06:07Z`,
+	}
+	if fmt.Sprint(entries) != fmt.Sprint(want) {
+		t.Errorf("entries\n%s\nwant\n%s", strings.Join(entries, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,107 @@
+package gmail
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// newGmailService creates a gmail service, and the HTTP client it uses,
+// authorised with tokens from the sources returned by newSource and
+// configured by opts
+func newGmailService(newSource func() oauth2.TokenSource, opts []option.ClientOption) (*gmail.Service, *http.Client, error) {
+	return newClientService(&http.Client{Transport: &authTransport{
+		newSource: newSource,
+		base:      http.DefaultTransport,
+	}}, opts)
+}
+
+// newClientService creates a gmail service sending its requests through a
+// copy of client configured by opts. The options are applied to the client
+// itself since gmail.NewService ignores those such as option.WithUserAgent
+// when given a client
+func newClientService(client *http.Client, opts []option.ClientOption) (*gmail.Service, *http.Client, error) {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	// client authorises its requests, the transport must not do it again
+	opts = append([]option.ClientOption{option.WithUserAgent(DefaultAppName)}, opts...)
+	trans, err := htransport.NewTransport(context.Background(), base, append(opts, option.WithoutAuthentication())...)
+	if err != nil {
+		return nil, nil, err
+	}
+	configured := *client
+	configured.Transport = trans
+
+	gmailSrv, err := gmail.NewService(context.Background(), append(opts, option.WithHTTPClient(&configured))...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gmailSrv, &configured, nil
+}
+
+// authTransport authorises requests with tokens from its source. A request
+// rejected with 401 Unauthorized, e.g. once a long run outlives its token, is
+// retried once with a token from a new source
+type authTransport struct {
+	// newSource returns a token source that obtains a token anew rather than
+	// reusing one it has cached
+	newSource func() oauth2.TokenSource
+	base      http.RoundTripper
+
+	mu  sync.Mutex
+	src oauth2.TokenSource
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	src := t.source(nil)
+	res, err := t.send(req, src)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+	// bodies that can't be replayed can't be retried
+	if req.Body != nil && req.GetBody == nil {
+		return res, nil
+	}
+	res.Body.Close()
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return t.send(retry, t.source(src))
+}
+
+// source returns the current token source, replacing it with a new one first
+// when it is stale. Concurrent requests rejected with the same source only
+// replace it once
+func (t *authTransport) source(stale oauth2.TokenSource) oauth2.TokenSource {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.src == nil || t.src == stale {
+		t.src = t.newSource()
+	}
+	return t.src
+}
+
+// send authorises a copy of req with a token from src and sends it
+func (t *authTransport) send(req *http.Request, src oauth2.TokenSource) (*http.Response, error) {
+	token, err := src.Token()
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	authReq := req.Clone(req.Context())
+	token.SetAuthHeader(authReq)
+	return t.base.RoundTrip(authReq)
+}
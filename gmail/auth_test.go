@@ -0,0 +1,103 @@
+package gmail
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+// countingSources returns token sources handing out token-1, token-2, ... one
+// per source
+func countingSources() func() oauth2.TokenSource {
+	var mu sync.Mutex
+	n := 0
+	return func() oauth2.TokenSource {
+		mu.Lock()
+		defer mu.Unlock()
+		n++
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token-" + strconv.Itoa(n)})
+	}
+}
+
+func TestAuthTransportRetriesUnauthorized(t *testing.T) {
+	tests := []struct {
+		name     string
+		rejected map[string]bool
+		want     int
+		wantAuth []string
+	}{
+		{name: "accepted", want: http.StatusOK, wantAuth: []string{"Bearer token-1"}},
+		{name: "401 then 200", rejected: map[string]bool{"Bearer token-1": true}, want: http.StatusOK, wantAuth: []string{"Bearer token-1", "Bearer token-2"}},
+		{name: "retried once", rejected: map[string]bool{"Bearer token-1": true, "Bearer token-2": true}, want: http.StatusUnauthorized, wantAuth: []string{"Bearer token-1", "Bearer token-2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var auths, bodies []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				auth := r.Header.Get("Authorization")
+				body, _ := ioutil.ReadAll(r.Body)
+				auths = append(auths, auth)
+				bodies = append(bodies, string(body))
+				if tt.rejected[auth] {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.Write([]byte("ok"))
+			}))
+			defer server.Close()
+
+			client := &http.Client{Transport: &authTransport{
+				newSource: countingSources(),
+				base:      http.DefaultTransport,
+			}}
+			res, err := client.Post(server.URL, "text/plain", strings.NewReader("payload"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", res.StatusCode, tt.want)
+			}
+			if strings.Join(auths, ",") != strings.Join(tt.wantAuth, ",") {
+				t.Errorf("authorizations = %v, want %v", auths, tt.wantAuth)
+			}
+			for _, body := range bodies {
+				if body != "payload" {
+					t.Errorf("body = %q, want the payload replayed", body)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthTransportKeepsSource(t *testing.T) {
+	var auths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auths = append(auths, r.Header.Get("Authorization"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &authTransport{
+		newSource: countingSources(),
+		base:      http.DefaultTransport,
+	}}
+	for i := 0; i < 3; i++ {
+		res, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	for _, auth := range auths {
+		if auth != "Bearer token-1" {
+			t.Errorf("authorization = %q, want the first source reused", auth)
+		}
+	}
+}
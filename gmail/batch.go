@@ -0,0 +1,186 @@
+package gmail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// batchURL is Gmail's batch endpoint. It is only meant to be replaced by
+// tests
+var batchURL = "https://www.googleapis.com/batch/gmail/v1"
+
+// maxBatchGet is the most messages requested per batch. Gmail accepts up to
+// 100 but throttles larger batches
+const maxBatchGet = 50
+
+// errNoBatchResponse is recorded for messages missing from a batch response
+var errNoBatchResponse = errors.New("no response in batch")
+
+// BatchGetMessages retrieves the messages with the given IDs through Gmail's
+// batch endpoint, honouring FieldMask.Get. A failing message doesn't fail its
+// batch: the messages retrieved and the errors of those that weren't are
+// returned keyed by ID. The error is only set when a whole batch failed
+func (srv *Service) BatchGetMessages(ctx context.Context, msgIds []string) (map[string]*gmail.Message, map[string]error, error) {
+	if srv.client == nil {
+		return nil, nil, errors.New("service has no credentials for batch requests")
+	}
+	client := srv.client
+
+	msgs := make(map[string]*gmail.Message, len(msgIds))
+	errs := make(map[string]error)
+	for len(msgIds) > 0 {
+		n := len(msgIds)
+		if n > maxBatchGet {
+			n = maxBatchGet
+		}
+		if err := srv.batchGet(ctx, client, msgIds[:n], msgs, errs); err != nil {
+			return msgs, errs, err
+		}
+		msgIds = msgIds[n:]
+	}
+	return msgs, errs, nil
+}
+
+// batchGet sends a single batch retrieving msgIds, recording the outcome of
+// each in msgs or errs
+func (srv *Service) batchGet(ctx context.Context, client *http.Client, msgIds []string, msgs map[string]*gmail.Message, errs map[string]error) error {
+	query := url.Values{}
+	if srv.FieldMask.Get != "" {
+		query.Set("fields", string(srv.FieldMask.Get))
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i, id := range msgIds {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", "application/http")
+		header.Set("Content-ID", "<"+strconv.Itoa(i)+">")
+		pw, err := mw.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		path := "/gmail/v1/users/" + url.PathEscape(srv.UserID) + "/messages/" + url.PathEscape(id)
+		if len(query) > 0 {
+			path += "?" + query.Encode()
+		}
+		fmt.Fprintf(pw, "GET %s\r\n\r\n", path)
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, batchURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err := googleapi.CheckResponse(res); err != nil {
+		return quotaError(err)
+	}
+
+	_, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(msgIds))
+	mr := multipart.NewReader(res.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		i, ok := batchIndex(part.Header.Get("Content-ID"), len(msgIds))
+		if !ok {
+			continue
+		}
+		id := msgIds[i]
+		seen[id] = true
+
+		msg, err := readBatchMessage(part)
+		if err != nil {
+			errs[id] = err
+			continue
+		}
+		msgs[id] = msg
+	}
+
+	for _, id := range msgIds {
+		if !seen[id] {
+			errs[id] = errNoBatchResponse
+		}
+	}
+	return nil
+}
+
+// batchIndex parses the index of the request a response Content-ID, such as
+// <response-3>, refers to
+func batchIndex(contentID string, n int) (int, bool) {
+	contentID = strings.Trim(contentID, "<>")
+	i, err := strconv.Atoi(strings.TrimPrefix(contentID, "response-"))
+	if err != nil || i < 0 || i >= n {
+		return 0, false
+	}
+	return i, true
+}
+
+// readBatchMessage reads the HTTP response held by a part of a batch response
+func readBatchMessage(part *multipart.Part) (*gmail.Message, error) {
+	res, err := http.ReadResponse(bufio.NewReader(part), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if err := googleapi.CheckResponse(res); err != nil {
+		return nil, quotaError(err)
+	}
+
+	msg := &gmail.Message{}
+	if err := json.NewDecoder(res.Body).Decode(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// prefetchMessages replaces the listed msgs with those retrieved in batches.
+// Messages a batch failed to retrieve are left to be retrieved individually,
+// which reports their errors as usual
+func (srv *Service) prefetchMessages(ctx context.Context, msgs []*gmail.Message) error {
+	ids := make([]string, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.Id
+	}
+
+	fetched, _, err := srv.BatchGetMessages(ctx, ids)
+	if errors.Is(err, ErrQuotaExceeded) {
+		return err
+	}
+	for i, msg := range msgs {
+		if m, ok := fetched[msg.Id]; ok && m.Payload != nil {
+			msgs[i] = m
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// batchServer answers batch requests for messages, which it knows by ID.
+// Others get 404 Not Found, and those of missing don't get a response at all
+func batchServer(t *testing.T, known map[string]string, missing string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			t.Errorf("request Content-Type: %v", err)
+			return
+		}
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		mw := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+		for {
+			p, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			req, _ := ioutil.ReadAll(p)
+			// GET /gmail/v1/users/me/messages/<id>?fields=...
+			path := strings.Fields(string(req))[1]
+			path = strings.SplitN(path, "?", 2)[0]
+			id := path[strings.LastIndex(path, "/")+1:]
+			if id == missing {
+				continue
+			}
+
+			contentID := strings.Replace(p.Header.Get("Content-ID"), "<", "<response-", 1)
+			pw, _ := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type": {"application/http"},
+				"Content-ID":   {contentID},
+			})
+			if body, ok := known[id]; ok {
+				fmt.Fprintf(pw, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+				continue
+			}
+			body := `{"error":{"code":404,"message":"Requested entity was not found."}}`
+			fmt.Fprintf(pw, "HTTP/1.1 404 Not Found\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		}
+		mw.Close()
+	}))
+}
+
+func TestBatchGetMessages(t *testing.T) {
+	server := batchServer(t, map[string]string{
+		"a": `{"id":"a","threadId":"ta","payload":{"mimeType":"multipart/mixed"}}`,
+		"c": `{"id":"c","threadId":"tc"}`,
+	}, "d")
+	defer server.Close()
+	defer func(u string) { batchURL = u }(batchURL)
+	batchURL = server.URL
+
+	srv := &Service{UserID: "me", client: server.Client()}
+	msgs, errs, err := srv.BatchGetMessages(context.Background(), []string{"a", "b", "c", "d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs["a"].ThreadId != "ta" || msgs["c"].ThreadId != "tc" {
+		t.Errorf("messages = %v", msgs)
+	}
+	if msgs["a"].Payload == nil || msgs["a"].Payload.MimeType != "multipart/mixed" {
+		t.Errorf("payload of a = %v", msgs["a"].Payload)
+	}
+	if len(errs) != 2 {
+		t.Errorf("errors = %v", errs)
+	}
+	if !isNotFound(errs["b"]) {
+		t.Errorf("error of b = %v, want 404", errs["b"])
+	}
+	if !errors.Is(errs["d"], errNoBatchResponse) {
+		t.Errorf("error of d = %v, want %v", errs["d"], errNoBatchResponse)
+	}
+}
+
+func TestBatchGetMessagesFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":{"code":500,"message":"backend error"}}`, http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	defer func(u string) { batchURL = u }(batchURL)
+	batchURL = server.URL
+
+	srv := &Service{UserID: "me", client: server.Client()}
+	if _, _, err := srv.BatchGetMessages(context.Background(), []string{"a"}); err == nil {
+		t.Error("failed batch returned no error")
+	}
+}
+
+func TestBatchIndex(t *testing.T) {
+	tests := []struct {
+		contentID string
+		want      int
+		wantOK    bool
+	}{
+		{"<response-0>", 0, true},
+		{"<response-3>", 3, true},
+		{"response-2", 2, true},
+		{"<response-4>", 0, false},
+		{"<response--1>", 0, false},
+		{"<response-x>", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := batchIndex(tt.contentID, 4)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("batchIndex(%q) = %d, %t, want %d, %t", tt.contentID, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
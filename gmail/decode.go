@@ -0,0 +1,103 @@
+package gmail
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"strings"
+	"unicode"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// decodeBody returns the contents of a part body. Data is always base64url
+// encoded by the API; beneath that, the Content-Transfer-Encoding declared
+// in headers picks the decoder, see decodeTransfer. Gmail reverses the
+// transfer encoding of the parts it returns although they still declare it,
+// so their bodies are decoded with nil headers
+func decodeBody(body *gmail.MessagePartBody, headers []*gmail.MessagePartHeader) ([]byte, error) {
+	data, err := base64.URLEncoding.DecodeString(stripSpace(body.Data))
+	if err != nil {
+		return nil, err
+	}
+	return decodeTransfer(data, headers)
+}
+
+// bodyReader decodes the body of a part returned by Gmail like decodeBody,
+// but as a stream, so the decoded contents are never held in memory in full
+func bodyReader(body *gmail.MessagePartBody) io.Reader {
+	return base64.NewDecoder(base64.URLEncoding, strings.NewReader(stripSpace(body.Data)))
+}
+
+// transferEncoding returns the lower cased Content-Transfer-Encoding of
+// headers, empty when there is none
+func transferEncoding(headers []*gmail.MessagePartHeader) string {
+	return strings.ToLower(strings.TrimSpace(headerValue(headers, "Content-Transfer-Encoding")))
+}
+
+// decodeTransfer reverses the Content-Transfer-Encoding declared in headers:
+// base64, tolerating missing padding as some senders leave it out, or
+// quoted-printable. Any other encoding, such as 7bit, 8bit or binary, leaves
+// data as it is
+func decodeTransfer(data []byte, headers []*gmail.MessagePartHeader) ([]byte, error) {
+	switch transferEncoding(headers) {
+	case "base64":
+		encoded := stripSpace(string(data))
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return base64.RawStdEncoding.DecodeString(strings.TrimRight(encoded, "="))
+		}
+		return decoded, nil
+	case "quoted-printable":
+		return ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(data)))
+	}
+	return data, nil
+}
+
+// stripSpace removes the whitespace, such as the CRLF line breaks of the
+// original MIME, that Data sometimes carries and base64 decoding rejects. Data
+// without any is returned as is, sparing a copy of large bodies
+func stripSpace(data string) string {
+	if strings.IndexFunc(data, unicode.IsSpace) < 0 {
+		return data
+	}
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, data)
+}
+
+// isGzipped reports whether the part headers declare a gzip Content-Encoding,
+// which some senders apply to attachments although MIME doesn't define it
+func isGzipped(headers []*gmail.MessagePartHeader) bool {
+	encoding := strings.ToLower(strings.TrimSpace(headerValue(headers, "Content-Encoding")))
+	return encoding == "gzip" || encoding == "x-gzip"
+}
+
+// decodePart returns the decoded contents of a part returned by Gmail,
+// decompressing them when DecodeContentEncoding is set
+func (srv *Service) decodePart(part *gmail.MessagePart) ([]byte, error) {
+	data, err := decodeBody(part.Body, nil)
+	if err != nil || !srv.DecodeContentEncoding || !isGzipped(part.Headers) {
+		return data, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(zr)
+}
+
+// partReader is the streaming counterpart of decodePart
+func (srv *Service) partReader(part *gmail.MessagePart) (io.Reader, error) {
+	r := bodyReader(part.Body)
+	if !srv.DecodeContentEncoding || !isGzipped(part.Headers) {
+		return r, nil
+	}
+	return gzip.NewReader(r)
+}
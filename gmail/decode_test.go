@@ -0,0 +1,146 @@
+package gmail
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestDecodeBody(t *testing.T) {
+	qp := []*gmail.MessagePartHeader{{Name: "Content-Transfer-Encoding", Value: "quoted-printable"}}
+	tests := []struct {
+		name    string
+		data    string
+		headers []*gmail.MessagePartHeader
+	}{
+		{name: "plain", data: "%PDF-1.4 binary\x00\xff"},
+		// Gmail has already reversed the transfer encoding
+		{name: "quoted-printable", data: "a,b   \nx=3D1,tot=\nal\n", headers: qp},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte(tt.data))}
+			got, err := decodeBody(body, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.data {
+				t.Errorf("decodeBody() = %q, want %q", got, tt.data)
+			}
+
+			part := &gmail.MessagePart{Body: body, Headers: tt.headers}
+			r, err := (&Service{}).partReader(part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			streamed, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(streamed) != tt.data {
+				t.Errorf("partReader() = %q, want %q", streamed, tt.data)
+			}
+		})
+	}
+}
+
+func TestDecodeBodyWhitespace(t *testing.T) {
+	encoded := base64.URLEncoding.EncodeToString([]byte("some attachment content"))
+	body := &gmail.MessagePartBody{Data: encoded[:10] + "\r\n" + encoded[10:]}
+	got, err := decodeBody(body, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "some attachment content" {
+		t.Errorf("decodeBody() = %q", got)
+	}
+}
+
+func TestDecodeBodyTransferEncoding(t *testing.T) {
+	tests := []struct {
+		encoding string
+		data     string
+		want     string
+	}{
+		{encoding: "", data: "x=3D1", want: "x=3D1"},
+		{encoding: "7bit", data: "x=3D1", want: "x=3D1"},
+		{encoding: "binary", data: "\x00\xff", want: "\x00\xff"},
+		{encoding: "base64", data: "aGVs\r\nbG8=", want: "hello"},
+		{encoding: "Base64", data: "aGVsbG8", want: "hello"},
+		{encoding: "quoted-printable", data: "x=3D1,tot=\r\nal", want: "x=1,total"},
+		{encoding: " Quoted-Printable ", data: "caf=C3=A9", want: "café"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			body := &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte(tt.data))}
+			var headers []*gmail.MessagePartHeader
+			if tt.encoding != "" {
+				headers = []*gmail.MessagePartHeader{{Name: "Content-Transfer-Encoding", Value: tt.encoding}}
+			}
+			got, err := decodeBody(body, headers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("decodeBody() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	body := &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte("not base64!"))}
+	headers := []*gmail.MessagePartHeader{{Name: "Content-Transfer-Encoding", Value: "base64"}}
+	if _, err := decodeBody(body, headers); err == nil {
+		t.Error("invalid base64 decoded without error")
+	}
+}
+
+func TestDecodeContentEncoding(t *testing.T) {
+	content := "%PDF-1.4 " + strings.Repeat("compressed statement ", 20)
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	io.WriteString(zw, content)
+	zw.Close()
+
+	tests := []struct {
+		name   string
+		decode bool
+		stream bool
+		want   string
+	}{
+		{name: "left compressed", want: gzipped.String()},
+		{name: "decoded", decode: true, want: content},
+		{name: "decoded streaming", decode: true, stream: true, want: content},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := pdfMessage("m1", time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), "a.pdf")
+			part := msg.Payload.Parts[0]
+			part.Headers = []*gmail.MessagePartHeader{{Name: "Content-Encoding", Value: "gzip"}}
+			part.Body = &gmail.MessagePartBody{
+				Data: base64.URLEncoding.EncodeToString(gzipped.Bytes()),
+				Size: int64(gzipped.Len()),
+			}
+			files := &memFiles{}
+			srv := newTestService(files, msg)
+			srv.DecodeContentEncoding = tt.decode
+			if tt.stream {
+				srv.StreamThreshold = 1
+			}
+
+			if _, _, err := srv.processMessages(context.Background(), listed(msg), false); err != nil {
+				t.Fatal(err)
+			}
+			if got := files.files["a.pdf-m1-0.pdf"].String(); got != tt.want {
+				t.Errorf("wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package gmail
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// ProcessEMLFile extracts the attachments of a raw RFC 822 message, such as
+// a saved .eml file, applying the same filters and writer generators as
+// ProcessPDFAttachments without calling Gmail. The message ID is taken from
+// the Message-ID header. Stats are started anew, as for a run
+func (srv *Service) ProcessEMLFile(r io.Reader) (ProcessedAttachments, error) {
+	m, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := emlPart(textproto.MIMEHeader(m.Header), m.Body, "")
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &gmail.Message{
+		Id:      strings.Trim(m.Header.Get("Message-Id"), "<> "),
+		Payload: payload,
+	}
+	if date, err := m.Header.Date(); err == nil {
+		msg.InternalDate = date.UnixNano() / int64(1e6)
+	}
+
+	if err := srv.resetStats(); err != nil {
+		return nil, err
+	}
+	parts, err := srv.retrieveMessageAttachments(context.Background(), msg, payload, make(map[string]*gmail.MessagePartBody))
+	if err != nil {
+		return nil, err
+	}
+
+	processedAttachments := make([]*ProcessedAttachment, 0, len(parts))
+	for _, r := range srv.processParts(context.Background(), msg, parts, nil, nil) {
+		if r.err != nil {
+			srv.reportError(msg.Id, r.part.PartId, r.err)
+			return processedAttachments, srv.Stats.recordError(msg, r.part.MessagePart, r.err)
+		}
+		if r.att != nil {
+			processedAttachments = append(processedAttachments, r.att)
+			if r.att.Quarantined == nil {
+				srv.Stats.Attachments++
+			}
+		}
+	}
+	return processedAttachments, nil
+}
+
+// emlPart converts a MIME entity into the part structure Gmail returns, with
+// bodies base64url encoded once their Content-Transfer-Encoding is reversed.
+// Quoted-printable parts of multipart entities are already decoded, and their
+// Content-Transfer-Encoding dropped, by mime/multipart
+func emlPart(header textproto.MIMEHeader, body io.Reader, partID string) (*gmail.MessagePart, error) {
+	part := &gmail.MessagePart{PartId: partID, MimeType: "text/plain"}
+	for name, values := range header {
+		for _, value := range values {
+			part.Headers = append(part.Headers, &gmail.MessagePartHeader{Name: name, Value: value})
+		}
+	}
+
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err == nil {
+		part.MimeType = mediaType
+		part.Filename = params["name"]
+	}
+	if _, dparams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil && dparams["filename"] != "" {
+		part.Filename = dparams["filename"]
+	}
+
+	if strings.HasPrefix(part.MimeType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for i := 0; ; i++ {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			id := strconv.Itoa(i)
+			if partID != "" {
+				id = partID + "." + id
+			}
+			child, err := emlPart(p.Header, p, id)
+			if err != nil {
+				return nil, err
+			}
+			part.Parts = append(part.Parts, child)
+		}
+		return part, nil
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = decodeTransfer(data, part.Headers); err != nil {
+		return nil, err
+	}
+	part.Body = &gmail.MessagePartBody{
+		Data: base64.URLEncoding.EncodeToString(data),
+		Size: int64(len(data)),
+	}
+	return part, nil
+}
@@ -0,0 +1,126 @@
+package gmail
+
+import (
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestEMLPartTransferEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		body     string
+		want     string
+	}{
+		{name: "quoted-printable", encoding: "quoted-printable", body: "x=3D1,tot=\r\nal\r\n", want: "x=1,total\r\n"},
+		{name: "base64", encoding: "base64", body: "aGVs\r\nbG8=\r\n", want: "hello"},
+		{name: "unpadded base64", encoding: "base64", body: "aGVsbG8", want: "hello"},
+		{name: "8bit", encoding: "8bit", body: "x=3D1", want: "x=3D1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := textproto.MIMEHeader{
+				"Content-Type":              {"text/csv"},
+				"Content-Transfer-Encoding": {tt.encoding},
+			}
+			part, err := emlPart(header, strings.NewReader(tt.body), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeBody(part.Body, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEMLPartMultipart(t *testing.T) {
+	header := textproto.MIMEHeader{"Content-Type": {`multipart/mixed; boundary="b"`}}
+	body := strings.Join([]string{
+		"--b",
+		"Content-Type: text/plain",
+		"",
+		"hi",
+		"--b",
+		`Content-Type: application/pdf; name="a.pdf"`,
+		"Content-Transfer-Encoding: quoted-printable",
+		"",
+		"%PDF=3D",
+		"--b--",
+		"",
+	}, "\r\n")
+	part, err := emlPart(header, strings.NewReader(body), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(part.Parts) != 2 {
+		t.Fatalf("got %d parts, want 2", len(part.Parts))
+	}
+	pdf := part.Parts[1]
+	if pdf.PartId != "1" || pdf.Filename != "a.pdf" || pdf.MimeType != "application/pdf" {
+		t.Errorf("part = %s %q %s", pdf.PartId, pdf.Filename, pdf.MimeType)
+	}
+	got, err := decodeBody(pdf.Body, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "%PDF=" {
+		t.Errorf("body = %q, want %q", got, "%PDF=")
+	}
+}
+
+func TestProcessEMLFile(t *testing.T) {
+	eml := strings.Join([]string{
+		"From: Reports <reports@example.com>",
+		"Subject: report",
+		"Date: Thu, 02 Jan 2020 10:00:00 +0000",
+		"Message-ID: <abc@example.com>",
+		`Content-Type: multipart/mixed; boundary="b"`,
+		"",
+		"--b",
+		"Content-Type: text/plain",
+		"",
+		"see attached",
+		"--b",
+		`Content-Type: application/pdf; name="report.pdf"`,
+		`Content-Disposition: attachment; filename="report.pdf"`,
+		"Content-Transfer-Encoding: base64",
+		"",
+		"JVBERi0xLjQ=",
+		"--b--",
+		"",
+	}, "\r\n")
+
+	files := &memFiles{}
+	srv := newTestService(files)
+	srv.Dedup = Suffix
+	var names []string
+	for i := 0; i < 2; i++ {
+		atts, err := srv.ProcessEMLFile(strings.NewReader(eml))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(atts) != 1 {
+			t.Fatalf("got %d attachments, want 1", len(atts))
+		}
+		att := atts[0]
+		if att.MessageID != "abc@example.com" || att.OriginalName != "report.pdf" || att.FromName != "Reports" {
+			t.Errorf("attachment = %s %s %s", att.MessageID, att.OriginalName, att.FromName)
+		}
+		if got := files.files[att.Filename].String(); got != "%PDF-1.4" {
+			t.Errorf("written %q", got)
+		}
+		if srv.Stats.Attachments != 1 {
+			t.Errorf("stats count %d attachments, want 1", srv.Stats.Attachments)
+		}
+		names = append(names, att.Filename)
+	}
+	if names[0] != names[1] {
+		t.Errorf("names differ between calls: %v", names)
+	}
+}
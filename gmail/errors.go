@@ -0,0 +1,136 @@
+package gmail
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// ErrQuotaExceeded is matched by errors.Is when Gmail rejects a call because
+// the user or project quota has been exhausted
+var ErrQuotaExceeded = errors.New("gmail quota exceeded")
+
+// quotaReasons are the error reasons Gmail reports when a quota is exhausted
+var quotaReasons = map[string]bool{
+	"dailyLimitExceeded":    true,
+	"userRateLimitExceeded": true,
+	"quotaExceeded":         true,
+}
+
+// ErrEmptyAttachment is returned when Gmail returns no data for an attachment
+// it reported a size for. The message is left unread so a later run retries
+var ErrEmptyAttachment = errors.New("attachment returned without data")
+
+// QuotaError is returned in place of the API error when a quota is exhausted
+type QuotaError struct {
+	// Reason as reported by Gmail e.g. dailyLimitExceeded
+	Reason string
+	// RetryAfter is the Retry-After hint sent with the response, zero when
+	// none was provided
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *QuotaError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%s (%s), retry after %s", ErrQuotaExceeded, e.Reason, e.RetryAfter)
+	}
+	return fmt.Sprintf("%s (%s)", ErrQuotaExceeded, e.Reason)
+}
+
+// Is reports whether target is ErrQuotaExceeded
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// Unwrap returns the original API error
+func (e *QuotaError) Unwrap() error {
+	return e.Err
+}
+
+// quotaError converts API errors caused by exhausted quotas into a QuotaError,
+// leaving any other error untouched
+func quotaError(err error) error {
+	apiErr, ok := err.(*googleapi.Error)
+	if !ok || (apiErr.Code != http.StatusForbidden && apiErr.Code != http.StatusTooManyRequests) {
+		return err
+	}
+
+	for _, item := range apiErr.Errors {
+		if quotaReasons[item.Reason] {
+			return &QuotaError{
+				Reason:     item.Reason,
+				RetryAfter: retryAfter(apiErr.Header),
+				Err:        err,
+			}
+		}
+	}
+	return err
+}
+
+// isNotFound reports whether err is an API error with a 404 status
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// isTransient reports whether err is an API error worth retrying: a rate
+// limit or a server side failure
+func isTransient(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= http.StatusInternalServerError
+}
+
+// isRetryable reports whether retrieving an attachment failed in a way that
+// may not happen again: a transient API error, a dropped connection or no
+// data being returned
+func isRetryable(err error) bool {
+	var netErr net.Error
+	return isTransient(err) || errors.Is(err, ErrEmptyAttachment) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+// ModifyError is returned when the labels of some messages couldn't be
+// modified, e.g. when marking them as read
+type ModifyError struct {
+	// MessageIDs lists the messages left unmodified
+	MessageIDs []string
+	// Err is the last error encountered
+	Err error
+}
+
+func (e *ModifyError) Error() string {
+	return fmt.Sprintf("modify %d message(s): %s", len(e.MessageIDs), e.Err)
+}
+
+// Unwrap returns the last error encountered
+func (e *ModifyError) Unwrap() error {
+	return e.Err
+}
+
+// retryAfter parses the Retry-After header which may either be in seconds or
+// an HTTP date
+func retryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := t.Sub(clockNow()); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,89 @@
+package gmail
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestQuotaError(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		quota bool
+	}{
+		{name: "rate limit", err: &googleapi.Error{Code: http.StatusTooManyRequests, Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}}}, quota: true},
+		{name: "daily limit", err: &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "dailyLimitExceeded"}}}, quota: true},
+		{name: "forbidden", err: &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "insufficientPermissions"}}}},
+		{name: "server error", err: &googleapi.Error{Code: http.StatusServiceUnavailable, Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded"}}}},
+		{name: "other", err: io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := quotaError(tt.err)
+			if got := errors.Is(err, ErrQuotaExceeded); got != tt.quota {
+				t.Errorf("quota error: %t, want %t", got, tt.quota)
+			}
+			if !tt.quota && err != tt.err {
+				t.Errorf("err = %v, want it untouched", err)
+			}
+		})
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		transient bool
+		retryable bool
+	}{
+		{name: "rate limit", err: &googleapi.Error{Code: http.StatusTooManyRequests}, transient: true, retryable: true},
+		{name: "server error", err: fmt.Errorf("get: %w", &googleapi.Error{Code: http.StatusBadGateway}), transient: true, retryable: true},
+		{name: "not found", err: &googleapi.Error{Code: http.StatusNotFound}},
+		{name: "empty attachment", err: ErrEmptyAttachment, retryable: true},
+		{name: "dropped connection", err: io.ErrUnexpectedEOF, retryable: true},
+		{name: "other", err: errors.New("bad data")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransient(tt.err); got != tt.transient {
+				t.Errorf("isTransient = %t, want %t", got, tt.transient)
+			}
+			if got := isRetryable(tt.err); got != tt.retryable {
+				t.Errorf("isRetryable = %t, want %t", got, tt.retryable)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		min   time.Duration
+		max   time.Duration
+	}{
+		{name: "missing"},
+		{name: "seconds", value: "30", min: 30 * time.Second, max: 30 * time.Second},
+		{name: "date", value: time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), min: 58 * time.Second, max: time.Minute},
+		{name: "past date", value: "Mon, 02 Jan 2006 15:04:05 GMT"},
+		{name: "invalid", value: "soon"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.value != "" {
+				header.Set("Retry-After", tt.value)
+			}
+			if got := retryAfter(header); got < tt.min || got > tt.max {
+				t.Errorf("retryAfter = %s, want between %s and %s", got, tt.min, tt.max)
+			}
+		})
+	}
+}
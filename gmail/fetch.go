@@ -0,0 +1,273 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// fetchedMessage is a listed message retrieved along with its matching
+// attachments
+type fetchedMessage struct {
+	msg   *gmail.Message
+	parts []*attachmentPart
+	// results are set when the parts were already processed during retrieval
+	results []*partResult
+	// skipped is set when the message lacks a label of RequireLabelIDs
+	skipped bool
+	err     error
+	// slot is the MaxMessagesPerRun slot the message holds, if any
+	slot chan struct{}
+}
+
+// release frees the slot of a message that doesn't count towards
+// MaxMessagesPerRun, letting another message be retrieved in its place
+func (res *fetchedMessage) release() {
+	if res.slot != nil {
+		<-res.slot
+	}
+}
+
+// partResult is the outcome of processing an attachment part
+type partResult struct {
+	part *attachmentPart
+	att  *ProcessedAttachment
+	err  error
+}
+
+// fetchMessages retrieves msgs and their attachments using up to Concurrency
+// goroutines. Results are sent in the same order as msgs, with no more than
+// Concurrency of them retrieved ahead of the receiver. When WriteConcurrency
+// is set the attachments are also processed, up to WriteConcurrency at a
+// time. When MaxMessagesPerRun is set no more messages are retrieved than
+// could still count towards it, each holding a slot until released by the
+// receiver. Cancelling ctx stops the retrieval early
+func (srv *Service) fetchMessages(ctx context.Context, msgs []*gmail.Message) <-chan *fetchedMessage {
+	done := ctx.Done()
+	workers := srv.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	var writeSem chan struct{}
+	if srv.WriteConcurrency > 0 {
+		writeSem = make(chan struct{}, srv.WriteConcurrency)
+	}
+	var slots chan struct{}
+	if srv.MaxMessagesPerRun > 0 {
+		slots = make(chan struct{}, srv.MaxMessagesPerRun)
+	}
+
+	// pending holds a result channel per message in listed order. Its
+	// capacity bounds how far ahead retrieval runs
+	pending := make(chan chan *fetchedMessage, workers)
+	go func() {
+		defer close(pending)
+		// names are claimed in listed order, each message taking its turn
+		// once the previous one is done
+		prev := make(chan struct{})
+		close(prev)
+		for _, msg := range msgs {
+			if slots != nil {
+				select {
+				case slots <- struct{}{}:
+				case <-done:
+					return
+				}
+			}
+			res := make(chan *fetchedMessage, 1)
+			select {
+			case pending <- res:
+			case <-done:
+				return
+			}
+			turn := &nameTurn{prev: prev, done: make(chan struct{})}
+			prev = turn.done
+			go func(msg *gmail.Message) {
+				defer turn.end()
+				fetched := srv.fetchMessage(ctx, msg)
+				fetched.slot = slots
+				if writeSem != nil && fetched.err == nil {
+					fetched.results = srv.processParts(ctx, fetched.msg, fetched.parts, writeSem, turn)
+				}
+				res <- fetched
+			}(msg)
+		}
+	}()
+
+	out := make(chan *fetchedMessage)
+	go func() {
+		defer close(out)
+		for res := range pending {
+			select {
+			case out <- <-res:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// hasLabels reports whether msg carries every label of ids
+func hasLabels(msg *gmail.Message, ids []string) bool {
+	for _, id := range ids {
+		found := false
+		for _, label := range msg.LabelIds {
+			if label == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// validMessages drops listed messages without an ID, which can't be
+// retrieved, counting them in Stats
+func (srv *Service) validMessages(msgs []*gmail.Message) []*gmail.Message {
+	valid := make([]*gmail.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if msg == nil || msg.Id == "" {
+			srv.Stats.InvalidMessages++
+			continue
+		}
+		valid = append(valid, msg)
+	}
+	return valid
+}
+
+// fetchMessage retrieves the full message, unless SkipMessageRefetch allows
+// using the listed payload or it was batch retrieved, and then the attachments
+// matched in it
+func (srv *Service) fetchMessage(ctx context.Context, msg *gmail.Message) *fetchedMessage {
+	res := &fetchedMessage{msg: msg}
+	refetch := !srv.SkipMessageRefetch && !(srv.BatchGet && srv.MessageFetcher == nil)
+	if refetch || msg.Payload == nil {
+		m, err := srv.getMessage(ctx, msg.Id)
+		if err == nil {
+			res.msg = m
+		} else if errors.Is(err, ErrQuotaExceeded) || isNotFound(err) || msg.Payload == nil {
+			res.err = fmt.Errorf("message %s: %w", msg.Id, err)
+			if !isNotFound(err) {
+				// vanished messages aren't failures
+				srv.reportError(msg.Id, "", res.err)
+			}
+			return res
+		}
+	}
+	if !hasLabels(res.msg, srv.RequireLabelIDs) {
+		res.skipped = true
+		return res
+	}
+	if res.msg.Payload == nil {
+		return res
+	}
+
+	// Retrieve the parts with attachments
+	bodies := make(map[string]*gmail.MessagePartBody)
+	res.parts, res.err = srv.retrieveMessageAttachments(ctx, res.msg, res.msg.Payload, bodies)
+	return res
+}
+
+// getMessage retrieves a message with MessageFetcher, or from Gmail when it
+// isn't set
+func (srv *Service) getMessage(ctx context.Context, msgID string) (*gmail.Message, error) {
+	if srv.MessageFetcher != nil {
+		return srv.MessageFetcher(ctx, msgID)
+	}
+	call := srv.srv.Users.Messages.Get(srv.UserID, msgID).Context(ctx)
+	if fields := srv.FieldMask.get(); len(fields) > 0 {
+		call = call.Fields(fields...)
+	}
+	msg, err := call.Do()
+	return msg, quotaError(err)
+}
+
+// nameTurn orders the claiming of names by messages processed concurrently:
+// a message claims its names once prev is closed, and closes done after
+type nameTurn struct {
+	prev  <-chan struct{}
+	done  chan struct{}
+	ended bool
+}
+
+// wait blocks until it is the message's turn
+func (t *nameTurn) wait() {
+	<-t.prev
+}
+
+// end passes the turn on to the next message, once it was taken
+func (t *nameTurn) end() {
+	if !t.ended {
+		t.wait()
+		t.ended = true
+		close(t.done)
+	}
+}
+
+// processParts processes the parts of msg in order. When sem is nil they are
+// processed one at a time; otherwise each holds a slot of sem while decoding
+// and while writing, claiming names in between once turn comes, so names
+// don't depend on which message is processed first. Like a sequential run
+// it stops at the first error that would abandon the message
+func (srv *Service) processParts(ctx context.Context, msg *gmail.Message, parts []*attachmentPart, sem chan struct{}, turn *nameTurn) []*partResult {
+	results := make([]*partResult, 0, len(parts))
+	if sem == nil {
+		for _, p := range parts {
+			att, err := srv.processAttachment(ctx, msg, p)
+			results = append(results, &partResult{part: p, att: att, err: err})
+			if srv.abandons(att, err) {
+				break
+			}
+		}
+		return results
+	}
+
+	prepared := make([]*preparedAttachment, 0, len(parts))
+	var failed *partResult
+	for _, p := range parts {
+		sem <- struct{}{}
+		pp, err := srv.prepareAttachment(msg, p)
+		<-sem
+		if err != nil {
+			failed = &partResult{part: p, err: err}
+			break
+		}
+		prepared = append(prepared, pp)
+	}
+
+	turn.wait()
+	for _, pp := range prepared {
+		srv.claimFilename(pp.att)
+	}
+	turn.end()
+
+	for _, pp := range prepared {
+		sem <- struct{}{}
+		att, err := srv.writeAttachment(ctx, pp)
+		<-sem
+		results = append(results, &partResult{part: pp.part, att: att, err: err})
+		if srv.abandons(att, err) {
+			return results
+		}
+	}
+	if failed != nil {
+		results = append(results, failed)
+	}
+	return results
+}
+
+// abandons reports whether the outcome of processing an attachment ends the
+// processing of its message
+func (srv *Service) abandons(att *ProcessedAttachment, err error) bool {
+	if err == nil {
+		return att != nil && att.WriteErr != nil && srv.FailFast
+	}
+	_, ok := err.(*WriterError)
+	return !ok || srv.FailFast || srv.OnWriterError == Fail
+}
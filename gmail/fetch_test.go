@@ -0,0 +1,317 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// delayed makes the fetcher of srv slower for messages listed earlier, so
+// later messages are retrieved first
+func delayed(srv *Service, msgs []*gmail.Message) {
+	delays := make(map[string]time.Duration, len(msgs))
+	for i, msg := range msgs {
+		delays[msg.Id] = time.Duration(len(msgs)-i) * time.Millisecond
+	}
+	fetch := srv.MessageFetcher
+	srv.MessageFetcher = func(ctx context.Context, msgID string) (*gmail.Message, error) {
+		select {
+		case <-time.After(delays[msgID]):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return fetch(ctx, msgID)
+	}
+}
+
+func TestFetchMessagesOrder(t *testing.T) {
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		concurrency, writeConcurrency int
+	}{
+		{concurrency: 0},
+		{concurrency: 1},
+		{concurrency: 4},
+		{concurrency: 16},
+		{concurrency: 4, writeConcurrency: 1},
+		{concurrency: 16, writeConcurrency: 3},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("concurrency %d write %d", tt.concurrency, tt.writeConcurrency), func(t *testing.T) {
+			msgs := make([]*gmail.Message, 12)
+			for i := range msgs {
+				msgs[i] = pdfMessage(fmt.Sprintf("m%02d", i), date, "a.pdf", "b.pdf")
+			}
+			files := &memFiles{}
+			srv := newTestService(files, msgs...)
+			srv.Concurrency = tt.concurrency
+			srv.WriteConcurrency = tt.writeConcurrency
+			delayed(srv, msgs)
+
+			i := 0
+			for res := range srv.fetchMessages(context.Background(), listed(msgs...)) {
+				if res.err != nil {
+					t.Fatalf("message %s: %v", res.msg.Id, res.err)
+				}
+				if want := msgs[i].Id; res.msg.Id != want {
+					t.Errorf("result %d is message %s, want %s", i, res.msg.Id, want)
+				}
+				if len(res.parts) != 2 {
+					t.Errorf("message %s has %d parts, want 2", res.msg.Id, len(res.parts))
+				}
+				if processed := res.results != nil; processed != (tt.writeConcurrency > 0) {
+					t.Errorf("message %s processed during retrieval: %t", res.msg.Id, processed)
+				}
+				i++
+			}
+			if i != len(msgs) {
+				t.Errorf("got %d results, want %d", i, len(msgs))
+			}
+			if n := len(files.names()); tt.writeConcurrency > 0 && n != 2*len(msgs) {
+				t.Errorf("wrote %d files, want %d", n, 2*len(msgs))
+			}
+		})
+	}
+}
+
+func TestFetchMessagesCancel(t *testing.T) {
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	msgs := make([]*gmail.Message, 50)
+	for i := range msgs {
+		msgs[i] = pdfMessage(fmt.Sprintf("m%02d", i), date, "a.pdf")
+	}
+	srv := newTestService(&memFiles{}, msgs...)
+	srv.Concurrency = 4
+	srv.WriteConcurrency = 2
+	delayed(srv, msgs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := srv.fetchMessages(ctx, listed(msgs...))
+	for i := 0; i < 2; i++ {
+		<-out
+	}
+	cancel()
+
+	closed := make(chan int)
+	go func() {
+		n := 0
+		for range out {
+			n++
+		}
+		closed <- n
+	}()
+	select {
+	case n := <-closed:
+		// at most the results retrieved ahead are still delivered
+		if n > srv.Concurrency+1 {
+			t.Errorf("got %d results after cancelling", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("results not closed after cancelling")
+	}
+}
+
+func TestFetchMessagesNames(t *testing.T) {
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	run := func(concurrency, writeConcurrency int) []string {
+		msgs := make([]*gmail.Message, 12)
+		for i := range msgs {
+			msgs[i] = pdfMessage(fmt.Sprintf("m%02d", i), date, "a.pdf", "a.pdf")
+		}
+		srv := newTestService(&memFiles{}, msgs...)
+		srv.Concurrency = concurrency
+		srv.WriteConcurrency = writeConcurrency
+		srv.Dedup = MessageIDPrefix
+		srv.FilenameTemplate = template.Must(template.New("").Parse("{{.OriginalName}}"))
+		delayed(srv, msgs)
+
+		var names []string
+		for res := range srv.fetchMessages(context.Background(), listed(msgs...)) {
+			results := res.results
+			if results == nil {
+				results = srv.processParts(context.Background(), res.msg, res.parts, nil, nil)
+			}
+			for _, r := range results {
+				if r.err != nil {
+					t.Fatalf("message %s: %v", res.msg.Id, r.err)
+				}
+				names = append(names, r.att.Filename)
+			}
+		}
+		return names
+	}
+
+	want := run(0, 0)
+	if want[0] != "a.pdf" || want[1] != "m00_a.pdf" {
+		t.Fatalf("sequential names start %v", want[:2])
+	}
+	for _, writeConcurrency := range []int{1, 3, 8} {
+		got := run(8, writeConcurrency)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("write concurrency %d: names %v, want %v", writeConcurrency, got, want)
+		}
+	}
+}
+
+func TestMaxMessagesPerRun(t *testing.T) {
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var msgs []*gmail.Message
+	for i := 1; i <= 6; i++ {
+		msgs = append(msgs, pdfMessage(fmt.Sprintf("m%d", i), date, "a.pdf"))
+	}
+	files := &memFiles{}
+	srv := newTestService(files, msgs...)
+	srv.Concurrency = 4
+	srv.WriteConcurrency = 2
+	srv.MaxMessagesPerRun = 3
+
+	// m1 fails, so doesn't count, leaving its slot to m4
+	var mu sync.Mutex
+	var fetched []string
+	fetch := srv.MessageFetcher
+	srv.MessageFetcher = func(ctx context.Context, msgID string) (*gmail.Message, error) {
+		mu.Lock()
+		fetched = append(fetched, msgID)
+		mu.Unlock()
+		if msgID == "m1" {
+			return nil, errors.New("broken")
+		}
+		return fetch(ctx, msgID)
+	}
+
+	_, progress, err := srv.processMessages(context.Background(), listed(msgs...), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.Stats.Messages != 3 || !progress.truncated {
+		t.Errorf("processed %d messages, truncated %v", srv.Stats.Messages, progress.truncated)
+	}
+	if got, want := fmt.Sprint(files.names()), "[a.pdf-m2-0.pdf a.pdf-m3-0.pdf a.pdf-m4-0.pdf]"; got != want {
+		t.Errorf("wrote %s, want %s", got, want)
+	}
+	sort.Strings(fetched)
+	if got, want := fmt.Sprint(fetched), "[m1 m2 m3 m4]"; got != want {
+		t.Errorf("retrieved %s, want %s", got, want)
+	}
+}
+
+func TestSkipMessageRefetch(t *testing.T) {
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	full := pdfMessage("full", date, "a.pdf")
+	bare := pdfMessage("bare", date, "b.pdf")
+	tests := []struct {
+		name string
+		skip bool
+		want string
+	}{
+		{name: "refetch", want: "[bare full]"},
+		{name: "skip", skip: true, want: "[bare]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := &memFiles{}
+			srv := newTestService(files, full, bare)
+			srv.SkipMessageRefetch = tt.skip
+			var mu sync.Mutex
+			var fetched []string
+			fetch := srv.MessageFetcher
+			srv.MessageFetcher = func(ctx context.Context, msgID string) (*gmail.Message, error) {
+				mu.Lock()
+				fetched = append(fetched, msgID)
+				mu.Unlock()
+				return fetch(ctx, msgID)
+			}
+
+			// the payload of full was already retrieved, e.g. by a history sync
+			msgs := []*gmail.Message{full, {Id: "bare"}}
+			if _, _, err := srv.processMessages(context.Background(), msgs, false); err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(fetched)
+			if got := fmt.Sprint(fetched); got != tt.want {
+				t.Errorf("retrieved %s, want %s", got, tt.want)
+			}
+			if got, want := fmt.Sprint(files.names()), "[a.pdf-full-0.pdf b.pdf-bare-0.pdf]"; got != want {
+				t.Errorf("wrote %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestVanishedMessage(t *testing.T) {
+	msg := pdfMessage("m1", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), "a.pdf")
+	files := &memFiles{}
+	// gone is deleted between being listed and retrieved
+	srv := newTestService(files, msg)
+	var reported []error
+	srv.OnError = func(msgID, partID string, err error) {
+		reported = append(reported, err)
+	}
+
+	msgs := []*gmail.Message{{Id: "gone"}, {Id: "m1"}}
+	_, progress, err := srv.processMessages(context.Background(), msgs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(srv.Stats.Vanished); got != "[gone]" {
+		t.Errorf("vanished %s, want [gone]", got)
+	}
+	if srv.Stats.Messages != 1 || len(srv.Stats.Errors) != 0 || len(reported) != 0 {
+		t.Errorf("processed %d messages, errors %v, reported %v", srv.Stats.Messages, srv.Stats.Errors, reported)
+	}
+	if got, want := fmt.Sprint(files.names()), "[a.pdf-m1-0.pdf]"; got != want {
+		t.Errorf("wrote %s, want %s", got, want)
+	}
+	// a vanished message doesn't hold back the next run
+	if _, ok := progress.resumeAt(time.Now(), true); !ok {
+		t.Error("vanished message left for the next run")
+	}
+}
+
+func TestMessageFetcher(t *testing.T) {
+	msg := pdfMessage("m1", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), "a.pdf")
+	fake := newFakeGmail(msg)
+	defer fake.Close()
+	cached := pdfMessage("m1", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), "cached.pdf")
+
+	for _, custom := range []bool{false, true} {
+		t.Run(fmt.Sprintf("custom %t", custom), func(t *testing.T) {
+			files := &memFiles{}
+			srv := fake.service(t, files)
+			var fetched []string
+			if custom {
+				srv.MessageFetcher = func(ctx context.Context, msgID string) (*gmail.Message, error) {
+					fetched = append(fetched, msgID)
+					return cached, nil
+				}
+			}
+			before := len(fake.requested("/messages/m1?"))
+			if _, err := srv.ProcessPDFAttachments(false); err != nil {
+				t.Fatal(err)
+			}
+
+			want, wantGets := "[a.pdf-m1-0.pdf]", 1
+			if custom {
+				want, wantGets = "[cached.pdf-m1-0.pdf]", 0
+				if got := fmt.Sprint(fetched); got != "[m1]" {
+					t.Errorf("fetcher called for %s, want [m1]", got)
+				}
+			}
+			if got := fmt.Sprint(files.names()); got != want {
+				t.Errorf("wrote %s, want %s", got, want)
+			}
+			if gets := len(fake.requested("/messages/m1?")) - before; gets != wantGets {
+				t.Errorf("retrieved from Gmail %d times, want %d", gets, wantGets)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package gmail
+
+import (
+	"google.golang.org/api/googleapi"
+)
+
+// FieldMask holds partial response masks applied to Gmail calls to reduce
+// the size of responses. Empty masks return every field.
+//
+// Trimming too much is silent: Gmail simply omits the fields, so a Get mask
+// missing payload, or parts of it, makes messages appear to have no
+// attachments
+type FieldMask struct {
+	// List is applied when listing messages
+	List googleapi.Field
+	// Get is applied when retrieving a message
+	Get googleapi.Field
+}
+
+// DefaultFieldMask keeps only what is needed to find and name attachments
+var DefaultFieldMask = FieldMask{
+	List: "messages(id,threadId),nextPageToken,resultSizeEstimate",
+	Get:  "id,threadId,labelIds,internalDate,snippet,payload",
+}
+
+// get returns the fields to pass when retrieving a message
+func (fm FieldMask) get() []googleapi.Field {
+	if fm.Get == "" {
+		return nil
+	}
+	return []googleapi.Field{fm.Get}
+}
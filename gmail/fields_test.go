@@ -0,0 +1,47 @@
+package gmail
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFieldMask(t *testing.T) {
+	fake := newFakeGmail(pdfMessage("m1", time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), "a.pdf"))
+	defer fake.Close()
+
+	// fields returns the mask of the last request made to path
+	fields := func(path string) string {
+		reqs := fake.requested(path)
+		last := reqs[len(reqs)-1]
+		query, err := url.ParseQuery(last[strings.Index(last, "?")+1:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return query.Get("fields")
+	}
+	tests := []struct {
+		name string
+		mask FieldMask
+	}{
+		{name: "default", mask: DefaultFieldMask},
+		{name: "custom", mask: FieldMask{List: "messages(id)", Get: "id,payload"}},
+		{name: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := fake.service(t, &memFiles{})
+			srv.FieldMask = tt.mask
+			if _, err := srv.ProcessPDFAttachments(false); err != nil {
+				t.Fatal(err)
+			}
+			if got := fields("/messages?"); got != string(tt.mask.List) {
+				t.Errorf("listed with fields %q, want %q", got, tt.mask.List)
+			}
+			if got := fields("/messages/m1?"); got != string(tt.mask.Get) {
+				t.Errorf("retrieved with fields %q, want %q", got, tt.mask.Get)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package gmail
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// attachmentFilename names the attachment by its content when
+// ContentAddressed is set, otherwise using FilenameTemplate, falling back to
+// constructFilename when no template is set or it yields an empty name. The
+// name is relative and can't climb out of the output directory
+func (srv *Service) attachmentFilename(msg *gmail.Message, part *gmail.MessagePart, att *ProcessedAttachment) (string, error) {
+	if srv.ContentAddressed {
+		return att.SHA256 + attachmentExt(part, srv.ExtensionOverrides), nil
+	}
+	if srv.FilenameTemplate != nil {
+		var b strings.Builder
+		if err := srv.FilenameTemplate.Execute(&b, att); err != nil {
+			return "", err
+		}
+		if name := sanitizePath(b.String()); name != "" {
+			return filepath.FromSlash(name), nil
+		}
+	}
+
+	// separators in the original filename aren't intentional
+	name := strings.NewReplacer("/", "_", `\`, "_").Replace(constructFilename(part, msg, srv.ExtensionOverrides))
+	return sanitizePath(name), nil
+}
+
+// DedupStrategy determines how names already used in a run are changed
+type DedupStrategy int
+
+const (
+	// NoDedup leaves names as they are, so later attachments may overwrite
+	// earlier ones
+	NoDedup DedupStrategy = iota
+	// Suffix appends _1, _2, ... to the name before its extension
+	Suffix
+	// HashPrefix prefixes the name with the start of the attachment's SHA256
+	HashPrefix
+	// MessageIDPrefix prefixes the name with the message ID
+	MessageIDPrefix
+	// ThreadDatePrefix only changes names used earlier in the same thread,
+	// prefixing them with the message date, e.g. 20200131-093000_
+	ThreadDatePrefix
+)
+
+// dedupFilename returns name unless it was already used in this run, in which
+// case it is changed according to Dedup. Prefixed names that still collide,
+// e.g. the same file attached twice, fall back to Suffix
+func (srv *Service) dedupFilename(name string, att *ProcessedAttachment) string {
+	claim := srv.Stats.claimName
+	if srv.Dedup == ThreadDatePrefix {
+		// names only need to be unique within the thread
+		claim = func(name string) bool {
+			return srv.Stats.claimName(att.ThreadID + "\x00" + name)
+		}
+	}
+	if srv.Dedup == NoDedup || claim(name) {
+		return name
+	}
+
+	dir, base := filepath.Split(name)
+	prefix := ""
+	switch srv.Dedup {
+	case HashPrefix:
+		prefix = att.SHA256[:8]
+	case MessageIDPrefix:
+		prefix = att.MessageID
+	case ThreadDatePrefix:
+		if date := att.partitionDate(); !date.IsZero() {
+			prefix = date.UTC().Format("20060102-150405")
+		}
+	}
+	if prefix != "" {
+		if prefixed := dir + prefix + "_" + base; claim(prefixed) {
+			return prefixed
+		}
+	}
+
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	for i := 1; ; i++ {
+		suffixed := dir + stem + "_" + strconv.Itoa(i) + ext
+		if claim(suffixed) {
+			return suffixed
+		}
+	}
+}
+
+// sanitizePath cleans a slash separated path: backslashes are treated as
+// separators, control characters are removed and empty, "." and ".."
+// segments are dropped
+func sanitizePath(name string) string {
+	segments := strings.Split(strings.ReplaceAll(name, `\`, "/"), "/")
+	clean := make([]string, 0, len(segments))
+	for _, seg := range segments {
+		seg = strings.TrimSpace(strings.Map(func(r rune) rune {
+			if r < 0x20 || r == 0x7f {
+				return -1
+			}
+			return r
+		}, seg))
+		if seg == "" || seg == "." || seg == ".." {
+			continue
+		}
+		clean = append(clean, seg)
+	}
+	return strings.Join(clean, "/")
+}
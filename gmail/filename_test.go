@@ -0,0 +1,181 @@
+package gmail
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"text/template"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestDedupFilename(t *testing.T) {
+	date := time.Date(2020, 1, 31, 9, 30, 0, 0, time.UTC)
+	att := &ProcessedAttachment{
+		MessageID: "m1",
+		ThreadID:  "t1",
+		SHA256:    "0123456789abcdef",
+		Date:      date,
+	}
+	other := &ProcessedAttachment{MessageID: "m2", ThreadID: "t2", SHA256: "fedcba9876543210", Date: date}
+
+	tests := []struct {
+		name  string
+		dedup DedupStrategy
+		// claimed are names claimed, by other, before att claims a.pdf
+		claimed []string
+		want    string
+	}{
+		{name: "unused", dedup: Suffix, want: "a.pdf"},
+		{name: "no dedup", dedup: NoDedup, claimed: []string{"a.pdf"}, want: "a.pdf"},
+		{name: "suffix", dedup: Suffix, claimed: []string{"a.pdf"}, want: "a_1.pdf"},
+		{name: "suffix taken", dedup: Suffix, claimed: []string{"a.pdf", "a_1.pdf"}, want: "a_2.pdf"},
+		{name: "hash prefix", dedup: HashPrefix, claimed: []string{"a.pdf"}, want: "01234567_a.pdf"},
+		{name: "message ID prefix", dedup: MessageIDPrefix, claimed: []string{"a.pdf"}, want: "m1_a.pdf"},
+		{name: "prefix taken", dedup: MessageIDPrefix, claimed: []string{"a.pdf", "m1_a.pdf"}, want: "a_1.pdf"},
+		{name: "other thread", dedup: ThreadDatePrefix, claimed: []string{"a.pdf"}, want: "a.pdf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &Service{Dedup: tt.dedup, Stats: &Stats{}}
+			for _, name := range tt.claimed {
+				srv.dedupFilename(name, other)
+			}
+			if got := srv.dedupFilename("a.pdf", att); got != tt.want {
+				t.Errorf("name = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("same thread", func(t *testing.T) {
+		srv := &Service{Dedup: ThreadDatePrefix, Stats: &Stats{}}
+		srv.dedupFilename("a.pdf", att)
+		if got, want := srv.dedupFilename("a.pdf", att), "20200131-093000_a.pdf"; got != want {
+			t.Errorf("name = %q, want %q", got, want)
+		}
+	})
+	t.Run("directory", func(t *testing.T) {
+		srv := &Service{Dedup: MessageIDPrefix, Stats: &Stats{}}
+		name := filepath.Join("dir", "a.pdf")
+		srv.dedupFilename(name, other)
+		if got, want := srv.dedupFilename(name, att), filepath.Join("dir", "m1_a.pdf"); got != want {
+			t.Errorf("name = %q, want %q", got, want)
+		}
+	})
+}
+
+func TestSanitizePath(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{name: "a.pdf", want: "a.pdf"},
+		{name: "dir/a.pdf", want: "dir/a.pdf"},
+		{name: "../../etc/passwd", want: "etc/passwd"},
+		{name: "/abs//./a.pdf", want: "abs/a.pdf"},
+		{name: `dir\..\a.pdf`, want: "dir/a.pdf"},
+		{name: "a\x00b\n.pdf", want: "ab.pdf"},
+		{name: " .. / . ", want: ""},
+	}
+	for _, tt := range tests {
+		if got := sanitizePath(tt.name); got != tt.want {
+			t.Errorf("sanitizePath(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAttachmentFilename(t *testing.T) {
+	msg := &gmail.Message{Id: "m1"}
+	part := &gmail.MessagePart{PartId: "2", Filename: "a/b.pdf", MimeType: "application/pdf"}
+	att := &ProcessedAttachment{MessageID: "m1", OriginalName: "../x.pdf", SHA256: "abc"}
+
+	tests := []struct {
+		name string
+		srv  *Service
+		want string
+	}{
+		{name: "default", srv: &Service{}, want: "a_b.pdf-m1-2.pdf"},
+		{name: "content addressed", srv: &Service{ContentAddressed: true}, want: "abc.pdf"},
+		{name: "template", srv: &Service{FilenameTemplate: mustTemplate("{{.MessageID}}/{{.OriginalName}}")}, want: filepath.Join("m1", "x.pdf")},
+		{name: "empty template", srv: &Service{FilenameTemplate: mustTemplate("..")}, want: "a_b.pdf-m1-2.pdf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.srv.attachmentFilename(msg, part, att)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("name = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func mustTemplate(text string) *template.Template {
+	return template.Must(template.New("").Parse(text))
+}
+
+func TestSubjectTemplate(t *testing.T) {
+	headers := []*gmail.MessagePartHeader{{Name: "subject", Value: "=?UTF-8?Q?Relev=C3=A9_de_mars?="}}
+	tests := []struct {
+		name string
+		msg  *gmail.Message
+		want string
+	}{
+		{name: "encoded", msg: &gmail.Message{Payload: &gmail.MessagePart{Headers: headers}}, want: "Relevé de mars"},
+		{name: "missing", msg: &gmail.Message{Payload: &gmail.MessagePart{}}, want: ""},
+		{name: "no payload", msg: &gmail.Message{}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := messageHeader(tt.msg, "Subject"); got != tt.want {
+				t.Errorf("subject = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	msg := pdfMessage("m1", date, "a.pdf")
+	msg.Payload.Headers = headers
+	files := &memFiles{}
+	srv := newTestService(files, msg)
+	srv.FilenameTemplate = mustTemplate("{{.Subject}}.pdf")
+	if _, _, err := srv.processMessages(context.Background(), listed(msg), false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(files.names()), "[Relevé de mars.pdf]"; got != want {
+		t.Errorf("wrote %s, want %s", got, want)
+	}
+}
+
+func TestContentAddressed(t *testing.T) {
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	first := pdfMessage("m1", date, "a.pdf")
+	copied := pdfMessage("m2", date, "b.pdf")
+	copied.Payload.Parts[0].Body = first.Payload.Parts[0].Body
+	other := pdfMessage("m3", date, "a.pdf")
+	msgs := []*gmail.Message{first, copied, other}
+	files := &memFiles{}
+	srv := newTestService(files, msgs...)
+	srv.ContentAddressed = true
+
+	atts, _, err := srv.processMessages(context.Background(), listed(msgs...), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]string)
+	for _, att := range atts {
+		names[att.MessageID] = att.Filename
+	}
+	sum := sha256.Sum256([]byte("%PDF-1.4 m1/a.pdf"))
+	if want := hex.EncodeToString(sum[:]) + ".pdf"; names["m1"] != want || names["m2"] != want {
+		t.Errorf("named the copies %q and %q, want %q", names["m1"], names["m2"], want)
+	}
+	if names["m3"] == names["m1"] || len(files.names()) != 2 {
+		t.Errorf("named the other attachment %q, wrote %v", names["m3"], files.names())
+	}
+}
@@ -0,0 +1,94 @@
+package gmail
+
+import (
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// skipReason tells which filter rejected a part
+type skipReason int
+
+const (
+	// notSkipped parts pass every filter
+	notSkipped skipReason = iota
+	// skipMimeType parts aren't of an accepted MIME type; their own parts
+	// may still be
+	skipMimeType
+	// skipDisposition parts don't have the OnlyDisposition disposition
+	skipDisposition
+	// skipFilename parts don't match FilenameRegex
+	skipFilename
+	// skipSize parts are smaller than MinAttachmentBytes
+	skipSize
+)
+
+// partFilter rejects a part of msg for the returned reason, or returns
+// notSkipped
+type partFilter func(srv *Service, msg *gmail.Message, part *gmail.MessagePart) skipReason
+
+// partFilters are the filters AND-combined by shouldProcess, in the order
+// they're applied. Filters that aren't enabled let every part through
+var partFilters = []partFilter{
+	mimeTypeFilter,
+	dispositionFilter,
+	filenameFilter,
+	sizeFilter,
+}
+
+// shouldProcess reports whether the part of msg passes every enabled filter,
+// and otherwise the reason of the first that rejected it
+func (srv *Service) shouldProcess(part *gmail.MessagePart, msg *gmail.Message) (bool, skipReason) {
+	for _, filter := range partFilters {
+		if reason := filter(srv, msg, part); reason != notSkipped {
+			return false, reason
+		}
+	}
+	return true, notSkipped
+}
+
+func mimeTypeFilter(srv *Service, msg *gmail.Message, part *gmail.MessagePart) skipReason {
+	if !srv.acceptsMimeType(part.MimeType) {
+		return skipMimeType
+	}
+	return notSkipped
+}
+
+func dispositionFilter(srv *Service, msg *gmail.Message, part *gmail.MessagePart) skipReason {
+	if srv.OnlyDisposition != "" && !strings.EqualFold(disposition(part), srv.OnlyDisposition) {
+		return skipDisposition
+	}
+	return notSkipped
+}
+
+func filenameFilter(srv *Service, msg *gmail.Message, part *gmail.MessagePart) skipReason {
+	if srv.FilenameRegex != nil && !srv.FilenameRegex.MatchString(originalFilename(part)) {
+		return skipFilename
+	}
+	return notSkipped
+}
+
+func sizeFilter(srv *Service, msg *gmail.Message, part *gmail.MessagePart) skipReason {
+	if part.Body != nil && part.Body.Size < srv.MinAttachmentBytes {
+		return skipSize
+	}
+	return notSkipped
+}
+
+// matchedBy describes the filters an accepted part matched, e.g.
+// mime:application/pdf,regex:^statement
+func (srv *Service) matchedBy(part *gmail.MessagePart) string {
+	pattern, _ := srv.matchMimeType(part.MimeType)
+	rules := []string{"mime:" + pattern}
+	if srv.OnlyDisposition != "" {
+		rules = append(rules, "disposition:"+srv.OnlyDisposition)
+	}
+	if srv.FilenameRegex != nil {
+		rules = append(rules, "regex:"+srv.FilenameRegex.String())
+	}
+	if srv.MinAttachmentBytes > 0 {
+		rules = append(rules, "size:"+strconv.FormatInt(srv.MinAttachmentBytes, 10))
+	}
+	return strings.Join(rules, ",")
+}
@@ -0,0 +1,54 @@
+package gmail
+
+import (
+	"regexp"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestShouldProcess(t *testing.T) {
+	pdf := &gmail.MessagePart{
+		MimeType: "application/pdf",
+		Filename: "statement-jan.pdf",
+		Headers:  []*gmail.MessagePartHeader{{Name: "Content-Disposition", Value: "attachment"}},
+		Body:     &gmail.MessagePartBody{Size: 2048},
+	}
+	tests := []struct {
+		name string
+		srv  *Service
+		part *gmail.MessagePart
+		want skipReason
+	}{
+		{name: "defaults", srv: &Service{}, part: pdf, want: notSkipped},
+		{name: "other type", srv: &Service{}, part: &gmail.MessagePart{MimeType: "image/png"}, want: skipMimeType},
+		{name: "multipart wildcard", srv: &Service{AcceptMimeTypes: []string{"*/*"}}, part: &gmail.MessagePart{MimeType: "multipart/mixed"}, want: skipMimeType},
+		{name: "disposition", srv: &Service{OnlyDisposition: "ATTACHMENT"}, part: pdf, want: notSkipped},
+		{name: "inline", srv: &Service{OnlyDisposition: "inline"}, part: pdf, want: skipDisposition},
+		{name: "filename", srv: &Service{FilenameRegex: regexp.MustCompile(`^statement`)}, part: pdf, want: notSkipped},
+		{name: "other filename", srv: &Service{FilenameRegex: regexp.MustCompile(`^invoice`)}, part: pdf, want: skipFilename},
+		{name: "large enough", srv: &Service{MinAttachmentBytes: 2048}, part: pdf, want: notSkipped},
+		{name: "too small", srv: &Service{MinAttachmentBytes: 4096}, part: pdf, want: skipSize},
+		{name: "first filter wins", srv: &Service{OnlyDisposition: "inline", MinAttachmentBytes: 4096}, part: pdf, want: skipDisposition},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, reason := tt.srv.shouldProcess(tt.part, &gmail.Message{})
+			if ok != (tt.want == notSkipped) || reason != tt.want {
+				t.Errorf("shouldProcess = %t, %d, want reason %d", ok, reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchedBy(t *testing.T) {
+	srv := &Service{
+		AcceptMimeTypes:    []string{"image/*", "application/pdf"},
+		FilenameRegex:      regexp.MustCompile(`^statement`),
+		MinAttachmentBytes: 10,
+	}
+	got := srv.matchedBy(&gmail.MessagePart{MimeType: "application/pdf"})
+	if want := "mime:application/pdf,regex:^statement,size:10"; got != want {
+		t.Errorf("matchedBy = %q, want %q", got, want)
+	}
+}
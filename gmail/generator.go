@@ -0,0 +1,352 @@
+package gmail
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PathGenerator writes each attachment to the file at the path returned by
+// path, which is set as the attachment's Path. Set the same path as
+// Service.OutputPath so the IfNewer policy checks the file written
+func PathGenerator(path func(att *ProcessedAttachment) string) AttachmentWriterGenerator {
+	return func(att *ProcessedAttachment) (io.Writer, error) {
+		att.Path = path(att)
+		return FileGenerator(att.Path)
+	}
+}
+
+// DirGenerator writes attachments to the paths of DirPath
+func DirGenerator(dir string, perRun bool) AttachmentWriterGenerator {
+	return PathGenerator(DirPath(dir, perRun))
+}
+
+// DirPath places attachments into dir. When perRun is set they are nested in
+// a directory named after the run ID, keeping the output of separate runs
+// apart
+func DirPath(dir string, perRun bool) func(att *ProcessedAttachment) string {
+	return func(att *ProcessedAttachment) string {
+		out := dir
+		if perRun && att.RunID != "" {
+			out = filepath.Join(dir, att.RunID)
+		}
+		return filepath.Join(out, att.Filename)
+	}
+}
+
+// ThreadGenerator writes attachments to the paths of ThreadPath
+func ThreadGenerator(dir string) AttachmentWriterGenerator {
+	return PathGenerator(ThreadPath(dir))
+}
+
+// ThreadPath places attachments into dir grouped by conversation, each thread
+// in a directory named after its ID. Attachments of messages without a
+// thread ID are placed in dir/unknown
+func ThreadPath(dir string) func(att *ProcessedAttachment) string {
+	return func(att *ProcessedAttachment) string {
+		thread := strings.NewReplacer("/", "_", `\`, "_").Replace(att.ThreadID)
+		if thread = sanitizePath(thread); thread == "" {
+			thread = "unknown"
+		}
+		return filepath.Join(dir, thread, att.Filename)
+	}
+}
+
+// ErrMultipleAttachments is returned by SingleWriterGenerator for every
+// attachment after the first
+var ErrMultipleAttachments = errors.New("only a single attachment can be written")
+
+// StdoutGenerator writes the attachment to standard output for piping into
+// another command, see SingleWriterGenerator
+func StdoutGenerator() WriterGenerator {
+	return SingleWriterGenerator(os.Stdout)
+}
+
+// SingleWriterGenerator writes a single attachment to w. Further attachments,
+// sidecars included, fail with ErrMultipleAttachments instead of being mixed
+// into the output, so narrow the run down, e.g. with SelectPerMessage and
+// MaxMessagesPerRun. w is never closed
+func SingleWriterGenerator(w io.Writer) WriterGenerator {
+	var mu sync.Mutex
+	used := false
+	return func(filename string) (io.Writer, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if used {
+			return nil, fmt.Errorf("%w: %s", ErrMultipleAttachments, filename)
+		}
+		used = true
+		// hide Read and Close of files such as os.Stdout
+		return writerFunc(w.Write), nil
+	}
+}
+
+// CreateFS is a file system attachments can be written to, such as an in
+// memory or network file system
+type CreateFS interface {
+	Create(name string) (io.WriteCloser, error)
+}
+
+// FSGenerator writes each attachment to the file of fsys named after it
+func FSGenerator(fsys CreateFS) WriterGenerator {
+	return func(filename string) (io.Writer, error) {
+		w, err := fsys.Create(filename)
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+}
+
+// OSFS is a CreateFS writing files below the directory it names, creating
+// missing parent directories like FileGenerator
+type OSFS string
+
+// Create creates or truncates the named file below the directory
+func (dir OSFS) Create(name string) (io.WriteCloser, error) {
+	w, err := FileGenerator(filepath.Join(string(dir), filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	}
+	return w.(*os.File), nil
+}
+
+// FromWriterGenerator adapts gen to an AttachmentWriterGenerator, e.g. for
+// decorators such as ModTimeGenerator
+func FromWriterGenerator(gen WriterGenerator) AttachmentWriterGenerator {
+	return func(att *ProcessedAttachment) (io.Writer, error) {
+		return gen(att.Filename)
+	}
+}
+
+// ModTimeGenerator wraps inner so files it writes get the message date as
+// their access and modification times once closed. Writers that aren't named
+// files, and attachments whose message date is unknown, are left as is
+func ModTimeGenerator(inner AttachmentWriterGenerator) AttachmentWriterGenerator {
+	return func(att *ProcessedAttachment) (io.Writer, error) {
+		w, err := inner(att)
+		if err != nil || att.Date.IsZero() {
+			return w, err
+		}
+		f, ok := w.(namedCloser)
+		if !ok {
+			return w, nil
+		}
+		return wrapWriter(w, w, &modTimeCloser{f, att.Date}), nil
+	}
+}
+
+// namedCloser is implemented by os.File
+type namedCloser interface {
+	io.Closer
+	Name() string
+}
+
+// modTimeCloser sets the modification time of a file after closing it
+type modTimeCloser struct {
+	f    namedCloser
+	date time.Time
+}
+
+func (c *modTimeCloser) Close() error {
+	if err := c.f.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(c.f.Name(), c.date, c.date)
+}
+
+// PartitionedFileGenerator writes attachments to the paths of
+// PartitionedPath
+func PartitionedFileGenerator(root string) AttachmentWriterGenerator {
+	return PathGenerator(PartitionedPath(root))
+}
+
+// PartitionedPath places attachments under root in YYYY/MM/DD directories
+// derived from the message date (in UTC). Gmail's internal date is used when
+// the Date header is missing or later than the message was received.
+// Attachments whose date is unknown are placed in root/unknown
+func PartitionedPath(root string) func(att *ProcessedAttachment) string {
+	return func(att *ProcessedAttachment) string {
+		partition := "unknown"
+		if date := att.partitionDate(); !date.IsZero() {
+			partition = date.UTC().Format("2006/01/02")
+		}
+		return filepath.Join(root, filepath.FromSlash(partition), att.Filename)
+	}
+}
+
+// CountingGenerator wraps inner, counting the bytes stored by each writer it
+// provides. The returned function reports the counts per filename. When
+// layer is set, such as a compressing or encrypting writer, attachments are
+// written through the writer it returns around the counted writer of inner,
+// so what the sink stores is counted rather than the decoded attachment.
+// Layered writers are closed, flushing the layer, as soon as the attachment
+// is written; counts are final once writers have been closed
+func CountingGenerator(inner WriterGenerator, layer func(w io.Writer) io.WriteCloser) (WriterGenerator, func() map[string]int64) {
+	var mu sync.Mutex
+	counts := make(map[string]int64)
+
+	gen := func(filename string) (io.Writer, error) {
+		w, err := inner(filename)
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		counts[filename] = 0
+		mu.Unlock()
+
+		counter := writerFunc(func(p []byte) (int, error) {
+			n, err := w.Write(p)
+			mu.Lock()
+			counts[filename] += int64(n)
+			mu.Unlock()
+			return n, err
+		})
+		if layer == nil {
+			return wrapWriter(w, counter, nil), nil
+		}
+		return &layeredWriter{WriteCloser: layer(counter), inner: w}, nil
+	}
+
+	report := func() map[string]int64 {
+		mu.Lock()
+		defer mu.Unlock()
+		snapshot := make(map[string]int64, len(counts))
+		for name, n := range counts {
+			snapshot[name] = n
+		}
+		return snapshot
+	}
+
+	return gen, report
+}
+
+// layeredWriter writes through a layer wrapping inner. Closing it closes the
+// layer and then inner, when it is a Closer
+type layeredWriter struct {
+	io.WriteCloser
+	inner io.Writer
+}
+
+func (w *layeredWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if closer, ok := w.inner.(io.Closer); ok {
+		if er := closer.Close(); er != nil && err == nil {
+			err = er
+		}
+	}
+	return err
+}
+
+// writerFunc adapts a function to io.Writer
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// HTTPPostGenerator streams each attachment as the body of a POST request to
+// url. Headers returned by headerFn, which may be nil, are added to the
+// request. The upload completes when the writer is closed, which reports
+// failed requests and non 2xx responses
+func HTTPPostGenerator(client *http.Client, url string, headerFn func(filename string) http.Header) WriterGenerator {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return func(filename string) (io.Writer, error) {
+		pr, pw := io.Pipe()
+		req, err := http.NewRequest(http.MethodPost, url, pr)
+		if err != nil {
+			return nil, err
+		}
+		if headerFn != nil {
+			for name, values := range headerFn(filename) {
+				req.Header[name] = values
+			}
+		}
+
+		w := &httpPostWriter{pw: pw, done: make(chan error, 1)}
+		go func() {
+			res, err := client.Do(req)
+			if err == nil {
+				io.Copy(ioutil.Discard, res.Body)
+				res.Body.Close()
+				if res.StatusCode < 200 || res.StatusCode > 299 {
+					err = fmt.Errorf("post %s: unexpected status %s", filename, res.Status)
+				}
+			}
+			// unblock writes if the request ended before the body was sent
+			pr.CloseWithError(err)
+			w.done <- err
+		}()
+		return w, nil
+	}
+}
+
+// httpPostWriter pipes writes into an in-flight POST request
+type httpPostWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+	once sync.Once
+	err  error
+}
+
+func (w *httpPostWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// Close ends the request body and waits for the response
+func (w *httpPostWriter) Close() error {
+	return w.finish(nil)
+}
+
+// Abort fails the request body with err so the upload isn't completed
+func (w *httpPostWriter) Abort(err error) error {
+	w.finish(err)
+	return nil
+}
+
+// finish ends the request body, failing it when err is set, and waits for the
+// response
+func (w *httpPostWriter) finish(err error) error {
+	w.once.Do(func() {
+		w.pw.CloseWithError(err)
+		w.err = <-w.done
+	})
+	return w.err
+}
+
+// TempFileGenerator writes each attachment to a new temporary file. Closing
+// the attachment, e.g. via ProcessedAttachments.Close, removes the file
+func TempFileGenerator() WriterGenerator {
+	return func(filename string) (io.Writer, error) {
+		f, err := ioutil.TempFile("", "*-"+filepath.Base(filename))
+		if err != nil {
+			return nil, err
+		}
+		return &tempFile{f}, nil
+	}
+}
+
+// tempFile is a file removed once closed
+type tempFile struct {
+	*os.File
+}
+
+// Close closes and removes the file, attempting the removal even if closing
+// fails
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	if rmErr := os.Remove(f.Name()); rmErr != nil && err == nil {
+		err = rmErr
+	}
+	return err
+}
@@ -0,0 +1,388 @@
+package gmail
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestCountingGenerator(t *testing.T) {
+	content := strings.Repeat("compressible attachment content ", 1000)
+	gzipLayer := func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+
+	tests := []struct {
+		name  string
+		layer func(io.Writer) io.WriteCloser
+	}{
+		{name: "plain"},
+		{name: "gzip", layer: gzipLayer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := &memFiles{}
+			gen, counts := CountingGenerator(files.generator, tt.layer)
+			w, err := gen("a.pdf")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.WriteString(w, content); err != nil {
+				t.Fatal(err)
+			}
+			if closer, ok := w.(io.Closer); ok {
+				if err := closer.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			stored := files.files["a.pdf"].Bytes()
+			if got := counts()["a.pdf"]; got != int64(len(stored)) {
+				t.Errorf("count = %d, want the %d bytes stored", got, len(stored))
+			}
+			if tt.layer == nil {
+				if string(stored) != content {
+					t.Error("stored content differs")
+				}
+				return
+			}
+			if len(stored) >= len(content) {
+				t.Errorf("stored %d bytes, want fewer than the %d written", len(stored), len(content))
+			}
+			zr, err := gzip.NewReader(bytes.NewReader(stored))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := ioutil.ReadAll(zr); string(got) != content {
+				t.Error("stored content doesn't decompress to what was written")
+			}
+		})
+	}
+}
+
+func TestHTTPPostGenerator(t *testing.T) {
+	var body []byte
+	var header http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		header = r.Header
+		if r.URL.Path == "/fail" {
+			http.Error(w, "rejected", http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+	headerFn := func(filename string) http.Header {
+		return http.Header{"X-Filename": {filename}, "Content-Type": {"application/pdf"}}
+	}
+
+	w, err := HTTPPostGenerator(ts.Client(), ts.URL+"/upload", headerFn)("report.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "%PDF-1.4 ")
+	io.WriteString(w, "report")
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "%PDF-1.4 report" {
+		t.Errorf("posted %q", body)
+	}
+	if header.Get("X-Filename") != "report.pdf" || header.Get("Content-Type") != "application/pdf" {
+		t.Errorf("posted headers %v", header)
+	}
+
+	w, err = HTTPPostGenerator(ts.Client(), ts.URL+"/fail", nil)("report.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "%PDF-1.4 report")
+	if err := w.(io.Closer).Close(); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("error = %v, want the unexpected status", err)
+	}
+}
+
+func TestTempFileGenerator(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", dir)
+
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	msgs := []*gmail.Message{pdfMessage("m1", date, "a.pdf"), pdfMessage("m2", date, "b.pdf")}
+	srv := newTestService(&memFiles{}, msgs...)
+	srv.WriterGenerator = TempFileGenerator()
+	atts, _, err := srv.processMessages(context.Background(), listed(msgs...), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, att := range atts {
+		content, err := ioutil.ReadFile(att.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Dir(att.Path) != dir || string(content) != "%PDF-1.4 "+att.MessageID+"/"+att.OriginalName {
+			t.Errorf("wrote %q to %s", content, att.Path)
+		}
+	}
+
+	if err := atts.Close(); err != nil {
+		t.Fatal(err)
+	}
+	left, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(atts) != 2 || len(left) != 0 {
+		t.Errorf("%d temp files left of %d attachments", len(left), len(atts))
+	}
+}
+
+func TestSingleWriterGenerator(t *testing.T) {
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	msg := pdfMessage("m1", date, "a.pdf", "b.pdf")
+	var out bytes.Buffer
+	srv := newTestService(&memFiles{}, msg)
+	srv.WriterGenerator = SingleWriterGenerator(&out)
+	atts, _, err := srv.processMessages(context.Background(), listed(msg), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "%PDF-1.4 m1/a.pdf" || len(atts) != 1 {
+		t.Errorf("wrote %q of %d attachments", out.String(), len(atts))
+	}
+	if len(srv.Stats.Errors) != 1 || !errors.Is(srv.Stats.Errors[0], ErrMultipleAttachments) {
+		t.Errorf("errors %v, want %v", srv.Stats.Errors, ErrMultipleAttachments)
+	}
+}
+
+func TestPartitionedFileGenerator(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	received := time.Date(2020, 3, 4, 10, 0, 0, 0, time.UTC)
+	dated := pdfMessage("dated", received, "a.pdf")
+	dated.Payload.Headers = append(dated.Payload.Headers, &gmail.MessagePartHeader{Name: "Date", Value: "Tue, 03 Mar 2020 23:30:00 -0200"})
+	headerless := pdfMessage("headerless", received, "b.pdf")
+	undated := pdfMessage("undated", time.Unix(0, 0), "c.pdf")
+	undated.InternalDate = 0
+	msgs := []*gmail.Message{dated, headerless, undated}
+
+	srv := newTestService(&memFiles{}, msgs...)
+	srv.AttachmentWriterGenerator = PartitionedFileGenerator(dir)
+	atts, _, err := srv.processMessages(context.Background(), listed(msgs...), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := atts.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"2020/03/04/a.pdf-dated-0.pdf",
+		"2020/03/04/b.pdf-headerless-0.pdf",
+		"unknown/c.pdf-undated-0.pdf",
+	} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(want))); err != nil {
+			t.Errorf("not written to %s: %v", want, err)
+		}
+	}
+}
+
+func TestDirGeneratorPerRun(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	msg := pdfMessage("m1", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), "a.pdf")
+	srv := newTestService(&memFiles{}, msg)
+	srv.AttachmentWriterGenerator = DirGenerator(dir, true)
+
+	var runIDs []string
+	for i := 0; i < 2; i++ {
+		atts, _, err := srv.processMessages(context.Background(), listed(msg), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := atts.Close(); err != nil {
+			t.Fatal(err)
+		}
+		runID := srv.Stats.RunID
+		if want := filepath.Join(dir, runID, "a.pdf-m1-0.pdf"); runID == "" || atts[0].RunID != runID || atts[0].Path != want {
+			t.Errorf("run %q wrote to %s, want %s", runID, atts[0].Path, want)
+		}
+		runIDs = append(runIDs, runID)
+	}
+	if runIDs[0] == runIDs[1] {
+		t.Errorf("runs share the ID %s", runIDs[0])
+	}
+	runs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 {
+		t.Errorf("%d run directories, want 2", len(runs))
+	}
+}
+
+func TestModTimeGenerator(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	received := time.Date(2020, 3, 4, 10, 0, 0, 0, time.UTC)
+	dated := pdfMessage("dated", received, "a.pdf")
+	dated.Payload.Headers = append(dated.Payload.Headers, &gmail.MessagePartHeader{Name: "Date", Value: "Wed, 04 Mar 2020 09:30:00 +0000"})
+	undated := pdfMessage("undated", received, "b.pdf")
+	msgs := []*gmail.Message{dated, undated}
+
+	srv := newTestService(&memFiles{}, msgs...)
+	srv.AttachmentWriterGenerator = ModTimeGenerator(DirGenerator(dir, false))
+	written := time.Now().Add(-time.Minute)
+	atts, _, err := srv.processMessages(context.Background(), listed(msgs...), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := atts.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "a.pdf-dated-0.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2020, 3, 4, 9, 30, 0, 0, time.UTC); !info.ModTime().Equal(want) {
+		t.Errorf("modified %s, want the message date %s", info.ModTime(), want)
+	}
+	// without a Date header the time of writing is kept
+	if info, err = os.Stat(filepath.Join(dir, "b.pdf-undated-0.pdf")); err != nil {
+		t.Fatal(err)
+	}
+	if info.ModTime().Before(written) {
+		t.Errorf("modified %s, want the time of writing", info.ModTime())
+	}
+}
+
+func TestNestedTemplatePath(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	msg := pdfMessage("m1", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), "../../evil.pdf")
+	srv := newTestService(&memFiles{}, msg)
+	srv.AttachmentWriterGenerator = DirGenerator(dir, false)
+	srv.FilenameTemplate = mustTemplate("{{.FromName}}/{{.MessageID}}/{{.OriginalName}}")
+
+	atts, _, err := srv.processMessages(context.Background(), listed(msg), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := atts.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(dir, "Reports", "m1", "evil.pdf")
+	if len(atts) != 1 || atts[0].Path != want {
+		t.Fatalf("wrote %v, want %s", atts.Paths(), want)
+	}
+	content, err := ioutil.ReadFile(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "%PDF-1.4 m1/../../evil.pdf" {
+		t.Errorf("wrote %q", content)
+	}
+}
+
+// memFS is an in-memory CreateFS
+type memFS map[string]*bytes.Buffer
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+func (fsys memFS) Create(name string) (io.WriteCloser, error) {
+	buf := new(bytes.Buffer)
+	fsys[name] = buf
+	return nopCloser{buf}, nil
+}
+
+func TestFSGenerator(t *testing.T) {
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	msg := pdfMessage("m1", date, "a.pdf", "b.pdf")
+	fsys := memFS{}
+	srv := newTestService(&memFiles{}, msg)
+	srv.WriterGenerator = FSGenerator(fsys)
+	if _, _, err := srv.processMessages(context.Background(), listed(msg), false); err != nil {
+		t.Fatal(err)
+	}
+	if len(fsys) != 2 || fsys["a.pdf-m1-0.pdf"].String() != "%PDF-1.4 m1/a.pdf" || fsys["b.pdf-m1-1.pdf"].String() != "%PDF-1.4 m1/b.pdf" {
+		t.Errorf("wrote %v", fsys)
+	}
+
+	t.Run("os", func(t *testing.T) {
+		dir, cleanup := tempDir(t)
+		defer cleanup()
+		w, err := OSFS(dir).Create("nested/a.pdf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, "%PDF")
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, "nested", "a.pdf"))
+		if err != nil || string(content) != "%PDF" {
+			t.Errorf("read %q, %v", content, err)
+		}
+	})
+}
+
+func TestThreadGenerator(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	first := pdfMessage("m1", date, "a.pdf")
+	first.ThreadId = "t1"
+	reply := pdfMessage("m2", date, "b.pdf")
+	reply.ThreadId = "t1"
+	escaping := pdfMessage("m3", date, "c.pdf")
+	escaping.ThreadId = "../t2"
+	threadless := pdfMessage("m4", date, "d.pdf")
+	threadless.ThreadId = ""
+	msgs := []*gmail.Message{first, reply, escaping, threadless}
+
+	srv := newTestService(&memFiles{}, msgs...)
+	srv.AttachmentWriterGenerator = ThreadGenerator(dir)
+	atts, _, err := srv.processMessages(context.Background(), listed(msgs...), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := atts.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"t1/a.pdf-m1-0.pdf",
+		"t1/b.pdf-m2-0.pdf",
+		".._t2/c.pdf-m3-0.pdf",
+		"unknown/d.pdf-m4-0.pdf",
+	} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(want))); err != nil {
+			t.Errorf("not written to %s: %v", want, err)
+		}
+	}
+
+	t.Run("template", func(t *testing.T) {
+		srv := newTestService(&memFiles{}, first)
+		srv.FilenameTemplate = mustTemplate("{{.ThreadID}}/{{.OriginalName}}")
+		atts, _, err := srv.processMessages(context.Background(), listed(first), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := filepath.Join("t1", "a.pdf"); len(atts) != 1 || atts[0].Filename != want {
+			t.Errorf("named %v, want %s", atts, want)
+		}
+	})
+}
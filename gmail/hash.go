@@ -0,0 +1,34 @@
+package gmail
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HashMismatchError is returned when an attachment's sha256 doesn't match the
+// one provided in Service.ExpectedHashes
+type HashMismatchError struct {
+	Filename string
+	Expected string
+	Actual   string
+}
+
+func (e *HashMismatchError) Error() string {
+	return fmt.Sprintf("sha256 mismatch for %s: expected %s, got %s",
+		e.Filename, e.Expected, e.Actual)
+}
+
+// verifyHash checks the hex encoded sha256 of an attachment against the
+// expected one for filename. Filenames missing from ExpectedHashes are not
+// verified
+func (srv *Service) verifyHash(filename, actual string) error {
+	expected, ok := srv.ExpectedHashes[filename]
+	if !ok {
+		return nil
+	}
+
+	if !strings.EqualFold(expected, actual) {
+		return &HashMismatchError{Filename: filename, Expected: expected, Actual: actual}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package gmail
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpectedHashes(t *testing.T) {
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	fake := newFakeGmail(pdfMessage("match", date, "a.pdf"), pdfMessage("mismatch", date, "b.pdf"), pdfMessage("unlisted", date, "c.pdf"))
+	defer fake.Close()
+	files := &memFiles{}
+	srv := fake.service(t, files)
+	sum := sha256.Sum256([]byte("%PDF-1.4 match/a.pdf"))
+	srv.ExpectedHashes = map[string]string{
+		"a.pdf-match-0.pdf":    strings.ToUpper(hex.EncodeToString(sum[:])),
+		"b.pdf-mismatch-0.pdf": hex.EncodeToString(sum[:]),
+	}
+
+	if _, err := srv.ProcessPDFAttachments(true); err != nil {
+		t.Fatal(err)
+	}
+	var mismatch *HashMismatchError
+	if len(srv.Stats.Errors) != 1 || !errors.As(srv.Stats.Errors[0], &mismatch) || mismatch.Filename != "b.pdf-mismatch-0.pdf" {
+		t.Fatalf("errors %v, want a mismatch of b.pdf", srv.Stats.Errors)
+	}
+	if mismatch.Expected != srv.ExpectedHashes[mismatch.Filename] || mismatch.Actual == mismatch.Expected {
+		t.Errorf("mismatch %+v", mismatch)
+	}
+	if got, want := fmt.Sprint(files.names()), "[a.pdf-match-0.pdf c.pdf-unlisted-0.pdf]"; got != want {
+		t.Errorf("wrote %s, want %s", got, want)
+	}
+	if got, want := fmt.Sprint(fake.markedRead()), "[match unlisted]"; got != want {
+		t.Errorf("marked %s as read, want %s", got, want)
+	}
+}
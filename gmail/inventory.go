@@ -0,0 +1,264 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// inventoryFields limits message retrieval to what is needed to describe the
+// attachments of a message
+const inventoryFields = "id,threadId,labelIds,internalDate,payload"
+
+// AttachmentInfo describes an attachment without its contents
+type AttachmentInfo struct {
+	MessageID string
+	PartID    string
+	Filename  string
+	MimeType  string
+	// Size as reported by Gmail
+	Size int64
+	// Date of the message, zero if it can't be parsed
+	Date time.Time
+	From string
+}
+
+// InventoryFormat is the format messages are retrieved in to describe their
+// attachments without downloading them
+type InventoryFormat int
+
+const (
+	// MetadataInventory retrieves messages in Gmail's metadata format, the
+	// cheapest, carrying the headers of the message but not its parts. Only
+	// messages that are themselves a single attachment are described
+	MetadataInventory InventoryFormat = iota
+	// FullInventory retrieves the whole part tree, finding every attachment.
+	// Attachments are only referenced by ID, but small bodies, such as the
+	// message text, are returned inline
+	FullInventory
+)
+
+// inventoryHeaders are retrieved in metadata format, besides WantedHeaders,
+// to describe messages that are a single attachment
+var inventoryHeaders = []string{"Content-Type", "Content-Disposition"}
+
+// getForInventory retrieves a message in format, without downloading its
+// attachments
+func (srv *Service) getForInventory(ctx context.Context, msgID string, format InventoryFormat) (*gmail.Message, error) {
+	call := srv.srv.Users.Messages.Get(srv.UserID, msgID).
+		Fields(googleapi.Field(inventoryFields)).Context(ctx)
+	if format == FullInventory {
+		call = call.Format("full")
+	} else {
+		call = call.Format("metadata").MetadataHeaders(append(srv.wantedHeaders(), inventoryHeaders...)...)
+	}
+	m, err := call.Do()
+	return m, quotaError(err)
+}
+
+// InventoryAttachments lists the attachments of the messages matched by
+// DefaultQ and LabelIDs. Byte data is not included and attachment bodies
+// are not downloaded; messages are retrieved according to InventoryFormat
+func (srv *Service) InventoryAttachments(ctx context.Context) ([]AttachmentInfo, error) {
+	msgs, err := srv.ListMessagesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]AttachmentInfo, 0)
+	for _, msg := range msgs {
+		m, err := srv.getForInventory(ctx, msg.Id, srv.InventoryFormat)
+		if err != nil {
+			return infos, err
+		}
+		if m.Payload == nil {
+			continue
+		}
+
+		date, from := messageDate(m), messageHeader(m, "From")
+		srv.WalkParts(m, func(part *gmail.MessagePart, depth int) error {
+			if isAttachment(part) {
+				info := AttachmentInfo{
+					MessageID: m.Id,
+					PartID:    part.PartId,
+					Filename:  originalFilename(part),
+					MimeType:  part.MimeType,
+					Date:      date,
+					From:      from,
+				}
+				if part.Body != nil {
+					info.Size = part.Body.Size
+				}
+				infos = append(infos, info)
+			}
+			return nil
+		})
+	}
+
+	return infos, nil
+}
+
+// DefaultWantedHeaders are the headers MessageHeaders retrieves when
+// Service.WantedHeaders is empty
+var DefaultWantedHeaders = []string{"From", "Date", "Subject"}
+
+// MessageHeaders returns the WantedHeaders of the messages ListMessages
+// matches, keyed by message ID. Messages are retrieved in Gmail's metadata
+// format, which carries only the requested headers and no parts
+func (srv *Service) MessageHeaders(ctx context.Context) (map[string][]*gmail.MessagePartHeader, error) {
+	msgs, err := srv.ListMessagesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := srv.wantedHeaders()
+	headers := make(map[string][]*gmail.MessagePartHeader, len(msgs))
+	for _, msg := range msgs {
+		call := srv.srv.Users.Messages.Get(srv.UserID, msg.Id).
+			Format("metadata").MetadataHeaders(wanted...).
+			Fields("id,payload/headers").Context(ctx)
+		m, err := call.Do()
+		if err != nil {
+			return headers, quotaError(err)
+		}
+		if m.Payload != nil {
+			headers[m.Id] = m.Payload.Headers
+		}
+	}
+	return headers, nil
+}
+
+// wantedHeaders returns WantedHeaders, or their default when unset
+func (srv *Service) wantedHeaders() []string {
+	if len(srv.WantedHeaders) == 0 {
+		return DefaultWantedHeaders
+	}
+	return srv.WantedHeaders
+}
+
+// CountMessages returns the number of messages ListMessages matches
+func (srv *Service) CountMessages(ctx context.Context) (int, error) {
+	msgs, err := srv.ListMessagesContext(ctx)
+	return len(msgs), err
+}
+
+// EstimateDownloadBytes sums the sizes of the attachments a run would
+// process, without downloading them. Sizes are those Gmail reports for the
+// decoded contents; Gmail transfers them base64 encoded, about a third larger.
+// Messages are retrieved according to InventoryFormat
+func (srv *Service) EstimateDownloadBytes(ctx context.Context) (int64, error) {
+	var total int64
+	err := srv.eachMatched(ctx, srv.InventoryFormat, func(msg *gmail.Message, parts []*gmail.MessagePart) {
+		for _, part := range parts {
+			total += bodySize(part)
+		}
+	})
+	return total, err
+}
+
+// PreviewAttachments lists the filenames of the attachments a run would
+// process, keyed by message ID, without downloading them. Messages without
+// any are left out. Messages are retrieved according to InventoryFormat
+func (srv *Service) PreviewAttachments(ctx context.Context) (map[string][]string, error) {
+	preview := make(map[string][]string)
+	err := srv.eachMatched(ctx, srv.InventoryFormat, func(msg *gmail.Message, parts []*gmail.MessagePart) {
+		for _, part := range parts {
+			preview[msg.Id] = append(preview[msg.Id], originalFilename(part))
+		}
+	})
+	return preview, err
+}
+
+// eachMatched calls fn with the parts of each listed message, retrieved in
+// format, a run would process, applying the same filters and selection
+// without recording Stats or downloading attachments
+func (srv *Service) eachMatched(ctx context.Context, format InventoryFormat, fn func(msg *gmail.Message, parts []*gmail.MessagePart)) error {
+	msgs, err := srv.ListMessagesContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		m, err := srv.getForInventory(ctx, msg.Id, format)
+		if err != nil {
+			return err
+		}
+		if !hasLabels(m, srv.RequireLabelIDs) {
+			continue
+		}
+
+		var matched []*gmail.MessagePart
+		srv.WalkParts(m, func(part *gmail.MessagePart, depth int) error {
+			if depth > srv.maxPartDepth() {
+				return SkipParts
+			}
+			ok, reason := srv.shouldProcess(part, m)
+			if ok {
+				matched = append(matched, part)
+			}
+			if reason != skipMimeType {
+				return SkipParts
+			}
+			return nil
+		})
+		if len(matched) > 0 {
+			fn(m, srv.selectParts(matched))
+		}
+	}
+	return nil
+}
+
+// isAttachment reports whether the part carries a file rather than the message
+// text
+func isAttachment(part *gmail.MessagePart) bool {
+	return originalFilename(part) != "" || (part.Body != nil && part.Body.AttachmentId != "")
+}
+
+// ErrNoAttachment is returned by LatestAttachment when no attachment matches
+var ErrNoAttachment = errors.New("no matching attachment")
+
+// LatestAttachment processes the single attachment, among those a run would
+// process, whose filename matches the namePattern glob (see filepath.Match)
+// and whose message Gmail received last, e.g. the most recent statement.
+// Messages are retrieved in full, regardless of InventoryFormat, as the
+// attachment is downloaded. Messages aren't marked as read. Stats are started
+// anew, as for a run
+func (srv *Service) LatestAttachment(ctx context.Context, namePattern string) (*ProcessedAttachment, error) {
+	if _, err := filepath.Match(namePattern, ""); err != nil {
+		return nil, err
+	}
+
+	var latest *gmail.Message
+	var latestPart *gmail.MessagePart
+	err := srv.eachMatched(ctx, FullInventory, func(msg *gmail.Message, parts []*gmail.MessagePart) {
+		if latest != nil && msg.InternalDate <= latest.InternalDate {
+			return
+		}
+		for _, part := range parts {
+			if ok, _ := filepath.Match(namePattern, originalFilename(part)); ok {
+				latest, latestPart = msg, part
+				return
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoAttachment, namePattern)
+	}
+
+	if err := srv.resetStats(); err != nil {
+		return nil, err
+	}
+	part, err := srv.retrievePart(ctx, latest, latestPart, make(map[string]*gmail.MessagePartBody))
+	if err != nil {
+		return nil, err
+	}
+	return srv.processAttachment(ctx, latest, part)
+}
@@ -0,0 +1,206 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestPreviewAttachmentsRequireLabelIDs(t *testing.T) {
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	labelled := pdfMessage("a", date, "a.pdf")
+	labelled.LabelIds = []string{"INBOX", "Label_1"}
+	unlabelled := pdfMessage("b", date, "b.pdf")
+	unlabelled.LabelIds = []string{"INBOX"}
+	fake := newFakeGmail(labelled, unlabelled)
+	defer fake.Close()
+
+	tests := []struct {
+		name    string
+		require []string
+		want    string
+	}{
+		{name: "no requirement", want: "map[a:[a.pdf] b:[b.pdf]]"},
+		{name: "required label", require: []string{"Label_1"}, want: "map[a:[a.pdf]]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := fake.service(t, &memFiles{})
+			srv.RequireLabelIDs = tt.require
+			srv.InventoryFormat = FullInventory
+			preview, err := srv.PreviewAttachments(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprint(preview); got != tt.want {
+				t.Errorf("preview = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLatestAttachment(t *testing.T) {
+	older := pdfMessage("older", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), "statement-jan.pdf")
+	newer := pdfMessage("newer", time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC), "statement-feb.pdf", "invoice.pdf")
+	other := pdfMessage("other", time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC), "invoice.pdf")
+	fake := newFakeGmail(other, older, newer)
+	defer fake.Close()
+
+	files := &memFiles{}
+	srv := fake.service(t, files)
+	srv.Dedup = Suffix
+	var names []string
+	for i := 0; i < 2; i++ {
+		att, err := srv.LatestAttachment(context.Background(), "statement-*.pdf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if att.MessageID != "newer" || att.OriginalName != "statement-feb.pdf" {
+			t.Errorf("got %s of %s", att.OriginalName, att.MessageID)
+		}
+		if srv.Stats.Attachments != 0 || len(srv.Stats.Errors) != 0 {
+			t.Errorf("stats carried over: %+v", srv.Stats)
+		}
+		names = append(names, att.Filename)
+	}
+	if names[0] != names[1] {
+		t.Errorf("names differ between calls: %v", names)
+	}
+
+	if _, err := srv.LatestAttachment(context.Background(), "receipt-*.pdf"); !errors.Is(err, ErrNoAttachment) {
+		t.Errorf("error = %v, want %v", err, ErrNoAttachment)
+	}
+}
+
+func TestInventoryFormat(t *testing.T) {
+	date := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+	multipart := pdfMessage("multi", date, "a.pdf", "b.pdf")
+	single := &gmail.Message{Id: "single", Payload: &gmail.MessagePart{
+		MimeType: "application/pdf",
+		Headers: []*gmail.MessagePartHeader{
+			{Name: "From", Value: "Reports <reports@example.com>"},
+			{Name: "Content-Type", Value: "application/pdf"},
+			{Name: "Content-Disposition", Value: `attachment; filename="c.pdf"`},
+			{Name: "Received", Value: "from mail.example.com"},
+		},
+		Body: &gmail.MessagePartBody{AttachmentId: "att-c", Size: 30},
+	}}
+	fake := newFakeGmail(multipart, single)
+	defer fake.Close()
+
+	tests := []struct {
+		name       string
+		format     InventoryFormat
+		wantFormat string
+		want       []string
+	}{
+		{name: "metadata", format: MetadataInventory, wantFormat: "format=metadata", want: []string{"single/c.pdf"}},
+		{name: "full", format: FullInventory, wantFormat: "format=full", want: []string{"multi/a.pdf", "multi/b.pdf", "single/c.pdf"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := fake.service(t, &memFiles{})
+			srv.InventoryFormat = tt.format
+			infos, err := srv.InventoryAttachments(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, info := range infos {
+				got = append(got, info.MessageID+"/"+info.Filename)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("attachments %v, want %v", got, tt.want)
+			}
+
+			gets := fake.requested("/messages/single?")
+			last := gets[len(gets)-1]
+			if !strings.Contains(last, tt.wantFormat) {
+				t.Errorf("retrieved with %s, want %s", last, tt.wantFormat)
+			}
+			if tt.format == MetadataInventory && !strings.Contains(last, "metadataHeaders=Content-Disposition") {
+				t.Errorf("metadata call %s lacks the headers needed", last)
+			}
+		})
+	}
+}
+
+func TestEstimateDownloadBytes(t *testing.T) {
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	inline := pdfMessage("inline", date, "a.pdf", "b.pdf")
+	referenced := pdfMessage("referenced", date, "c.pdf", "d.zip")
+	referenced.Payload.Parts[0].Body = &gmail.MessagePartBody{AttachmentId: "att-c", Size: 1000}
+	referenced.Payload.Parts[1].MimeType = "application/zip"
+	referenced.Payload.Parts[1].Body = &gmail.MessagePartBody{AttachmentId: "att-d", Size: 5000}
+	fake := newFakeGmail(inline, referenced)
+	defer fake.Close()
+	srv := fake.service(t, &memFiles{})
+	srv.InventoryFormat = FullInventory
+
+	total, err := srv.EstimateDownloadBytes(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the inline parts hold "%PDF-1.4 inline/a.pdf" and its b.pdf twin
+	if want := int64(2*len("%PDF-1.4 inline/a.pdf") + 1000); total != want {
+		t.Errorf("estimated %d bytes, want %d", total, want)
+	}
+	if n := len(fake.requested("/attachments/")); n != 0 {
+		t.Errorf("downloaded %d attachments", n)
+	}
+
+	count, err := srv.CountMessages(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("counted %d messages, want 2", count)
+	}
+}
+
+func TestMessageHeaders(t *testing.T) {
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	msg := pdfMessage("m1", date, "a.pdf")
+	msg.Payload.Headers = append(msg.Payload.Headers,
+		&gmail.MessagePartHeader{Name: "Date", Value: "Thu, 2 Jan 2020 00:00:00 +0000"},
+		&gmail.MessagePartHeader{Name: "Received", Value: "from mail.example.com"})
+
+	tests := []struct {
+		name   string
+		wanted []string
+		query  string
+		want   string
+	}{
+		{name: "default", query: "metadataHeaders=From&metadataHeaders=Date&metadataHeaders=Subject", want: "[From Subject Date]"},
+		{name: "wanted", wanted: []string{"Received"}, query: "metadataHeaders=Received", want: "[Received]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeGmail(msg)
+			defer fake.Close()
+			srv := fake.service(t, &memFiles{})
+			srv.WantedHeaders = tt.wanted
+
+			headers, err := srv.MessageHeaders(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, header := range headers["m1"] {
+				names = append(names, header.Name)
+			}
+			if fmt.Sprint(names) != tt.want {
+				t.Errorf("headers %v, want %s", names, tt.want)
+			}
+			gets := fake.requested("/messages/m1?")
+			if len(gets) != 1 || !strings.Contains(gets[0], "format=metadata") || !strings.Contains(gets[0], tt.query) {
+				t.Errorf("requested %v, want the metadata format with %s", gets, tt.query)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package gmail
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrLabelNotFound is returned when a label name can't be resolved to an ID
+var ErrLabelNotFound = errors.New("label not found")
+
+// Folder is a system label restricting ListMessages to one mail folder
+type Folder string
+
+const (
+	// AllMail searches every folder
+	AllMail Folder = ""
+	// Inbox searches only the inbox
+	Inbox Folder = "INBOX"
+	// Sent searches sent mail
+	Sent Folder = "SENT"
+	// Drafts searches drafts. Drafts may be incomplete: attachments still
+	// uploading or missing headers such as Date are common
+	Drafts Folder = "DRAFT"
+)
+
+// Category is an inbox tab restricting ListMessages
+type Category string
+
+const (
+	// AnyCategory doesn't restrict messages to a tab
+	AnyCategory Category = ""
+	// Primary is the primary tab
+	Primary Category = "primary"
+	// Social is the social tab
+	Social Category = "social"
+	// Promotions is the promotions tab
+	Promotions Category = "promotions"
+	// Updates is the updates tab, where automated reports often land
+	Updates Category = "updates"
+	// Forums is the forums tab
+	Forums Category = "forums"
+)
+
+// labelIDs returns the label IDs ListMessages is restricted to
+func (srv *Service) labelIDs() []string {
+	if srv.Folder == AllMail {
+		return srv.LabelIDs
+	}
+	ids := make([]string, 0, len(srv.LabelIDs)+1)
+	ids = append(ids, srv.LabelIDs...)
+	return append(ids, string(srv.Folder))
+}
+
+// OnlyLabel restricts ListMessages to messages carrying the named label. The
+// restriction is combined with DefaultQ
+func (srv *Service) OnlyLabel(name string) error {
+	id, err := srv.labelID(name)
+	if err != nil {
+		return err
+	}
+	srv.LabelIDs = []string{id}
+	return nil
+}
+
+// labelID resolves a label name to its ID, fetching the user's labels once
+// and caching them for subsequent lookups
+func (srv *Service) labelID(name string) (string, error) {
+	if srv.labels == nil {
+		rep, err := srv.srv.Users.Labels.List(srv.UserID).Do()
+		if err != nil {
+			return "", quotaError(err)
+		}
+		srv.labels = make(map[string]string, len(rep.Labels))
+		for _, label := range rep.Labels {
+			srv.labels[label.Name] = label.Id
+		}
+	}
+
+	id, ok := srv.labels[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrLabelNotFound, name)
+	}
+	return id, nil
+}
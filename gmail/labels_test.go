@@ -0,0 +1,77 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestOnlyLabel(t *testing.T) {
+	fake := newFakeGmail()
+	defer fake.Close()
+	fake.labels = []*gmail.Label{{Id: "INBOX", Name: "INBOX"}, {Id: "Label_7", Name: "Bank Statements"}}
+	srv := fake.service(t, &memFiles{})
+	srv.DefaultQ = "has:attachment"
+
+	if err := srv.OnlyLabel("Bank Statements"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.ListMessagesContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	lists := fake.requested("/messages?")
+	query, err := url.ParseQuery(lists[0][strings.Index(lists[0], "?")+1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query.Get("labelIds") != "Label_7" || query.Get("q") != "has:attachment" {
+		t.Errorf("listed with labels %q and query %q", query["labelIds"], query.Get("q"))
+	}
+
+	if err := srv.OnlyLabel("Receipts"); !errors.Is(err, ErrLabelNotFound) {
+		t.Errorf("err = %v, want %v", err, ErrLabelNotFound)
+	}
+	if n := len(fake.requested("/labels?")); n != 1 {
+		t.Errorf("listed labels %d times, want them cached", n)
+	}
+}
+
+func TestFolder(t *testing.T) {
+	fake := newFakeGmail()
+	defer fake.Close()
+	tests := []struct {
+		name     string
+		folder   Folder
+		labelIDs []string
+		want     string
+	}{
+		{name: "all mail", want: "[]"},
+		{name: "sent", folder: Sent, want: "[SENT]"},
+		{name: "drafts", folder: Drafts, want: "[DRAFT]"},
+		{name: "labelled inbox", folder: Inbox, labelIDs: []string{"Label_7"}, want: "[Label_7 INBOX]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := fake.service(t, &memFiles{})
+			srv.Folder = tt.folder
+			srv.LabelIDs = tt.labelIDs
+			if _, err := srv.ListMessagesContext(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			lists := fake.requested("/messages?")
+			last := lists[len(lists)-1]
+			query, err := url.ParseQuery(last[strings.Index(last, "?")+1:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprint(query["labelIds"]); got != tt.want {
+				t.Errorf("listed with labels %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
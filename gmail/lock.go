@@ -0,0 +1,35 @@
+package gmail
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// ErrLocked is returned when Service.Lockfile is held by another run
+var ErrLocked = errors.New("another run holds the lock")
+
+// acquireLock creates the lockfile at path, holding the process ID, failing
+// with ErrLocked if it exists. The returned function releases the lock
+func acquireLock(path string) (func() error, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrLocked, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	return func() error {
+		return os.Remove(path)
+	}, nil
+}
@@ -0,0 +1,34 @@
+package gmail
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAcquireLock(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "run.lock")
+
+	release, err := acquireLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acquireLock(path); !errors.Is(err, ErrLocked) {
+		t.Errorf("second lock err = %v, want ErrLocked", err)
+	}
+	if err := release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("lockfile left after release: %v", err)
+	}
+
+	release, err = acquireLock(path)
+	if err != nil {
+		t.Fatalf("lock after release: %v", err)
+	}
+	release()
+}
@@ -1,13 +1,18 @@
 package gmail
 
 import (
-	"encoding/base64"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"mime"
+	"net/mail"
 	"os"
 	"strings"
+	"time"
 
 	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
 )
 
 func processMessage(srv *gmail.Service, userID string, msg *gmail.Message) error {
@@ -57,13 +62,139 @@ func printPartHeaders(headers []*gmail.MessagePartHeader, indent int) {
 	}
 }
 
-func retrieveMessage(srv *gmail.Service, userID, msgID string) (*gmail.Message, error) {
+// headerValue returns the value of the first header matching name. Matching
+// is case-insensitive and an empty string is returned when none matches
+func headerValue(headers []*gmail.MessagePartHeader, name string) string {
+	for _, header := range headers {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
+		}
+	}
+	return ""
+}
+
+// captureHeaders returns the message's top-level headers whose names are in
+// names, ignoring case
+func captureHeaders(msg *gmail.Message, names []string) []*gmail.MessagePartHeader {
+	if len(names) == 0 || msg.Payload == nil {
+		return nil
+	}
+
+	captured := make([]*gmail.MessagePartHeader, 0, len(names))
+	for _, header := range msg.Payload.Headers {
+		for _, name := range names {
+			if strings.EqualFold(header.Name, name) {
+				captured = append(captured, header)
+				break
+			}
+		}
+	}
+	return captured
+}
+
+// hasBody reports whether the part carries content of its own, either inline
+// or as an attachment
+func hasBody(part *gmail.MessagePart) bool {
+	return part.Body != nil && (part.Body.Data != "" || part.Body.AttachmentId != "")
+}
+
+// disposition returns the disposition type of the part, e.g. attachment or
+// inline, lower cased. It is empty when the part has no Content-Disposition
+func disposition(part *gmail.MessagePart) string {
+	value := headerValue(part.Headers, "Content-Disposition")
+	if i := strings.IndexByte(value, ';'); i >= 0 {
+		value = value[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+// originalFilename returns the decoded filename of the part. The
+// Content-Disposition filename, including the RFC 2231 filename*= form, takes
+// precedence over part.Filename, which Gmail sometimes leaves empty
+func originalFilename(part *gmail.MessagePart) string {
+	name := part.Filename
+	if _, params, err := mime.ParseMediaType(headerValue(part.Headers, "Content-Disposition")); err == nil && params["filename"] != "" {
+		name = params["filename"]
+	}
+	return decodeHeader(name)
+}
+
+// bodySize returns the size of the part's body as reported by Gmail
+func bodySize(part *gmail.MessagePart) int64 {
+	if part.Body == nil {
+		return 0
+	}
+	return part.Body.Size
+}
+
+// decodeHeader decodes RFC 2047 encoded words, returning the raw value if it
+// can't be decoded
+func decodeHeader(value string) string {
+	dec := new(mime.WordDecoder)
+	decoded, err := dec.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// messageHeader returns the decoded value of the named top-level header
+func messageHeader(msg *gmail.Message, name string) string {
+	if msg.Payload == nil {
+		return ""
+	}
+	return decodeHeader(headerValue(msg.Payload.Headers, name))
+}
+
+// parseFrom splits a From header into the sender's address and display name.
+// The decoded header is returned as the address when it can't be parsed
+func parseFrom(header string) (addr, name string) {
+	parsed, err := mail.ParseAddress(header)
+	if err != nil {
+		return decodeHeader(header), ""
+	}
+	return parsed.Address, parsed.Name
+}
+
+// deliveredTo returns the first Delivered-To header of the message, falling
+// back to the To header
+func deliveredTo(msg *gmail.Message) string {
+	if to := messageHeader(msg, "Delivered-To"); to != "" {
+		return to
+	}
+	return messageHeader(msg, "To")
+}
+
+// messageDate parses the message's Date header, returning the zero time when
+// it is missing or malformed
+func messageDate(msg *gmail.Message) time.Time {
+	date, err := mail.ParseDate(messageHeader(msg, "Date"))
+	if err != nil {
+		return time.Time{}
+	}
+	return date
+}
+
+// internalDate converts the message's internalDate, in milliseconds since the
+// epoch, to a time. Zero if it isn't set
+func internalDate(msg *gmail.Message) time.Time {
+	if msg.InternalDate == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, msg.InternalDate*int64(time.Millisecond))
+}
+
+func retrieveMessage(srv *gmail.Service, userID, msgID string, fields ...googleapi.Field) (*gmail.Message, error) {
 	call := srv.Users.Messages.Get(userID, msgID)
-	return call.Do()
+	if len(fields) > 0 {
+		call = call.Fields(fields...)
+	}
+	msg, err := call.Do()
+	return msg, quotaError(err)
 }
 
-func constructFilename(part *gmail.MessagePart, msg *gmail.Message) string {
-	return fmt.Sprintf("%s-%s-%s.pdf", part.Filename, msg.Id, part.PartId)
+func constructFilename(part *gmail.MessagePart, msg *gmail.Message, extOverrides map[string]string) string {
+	return fmt.Sprintf("%s-%s-%s%s", originalFilename(part), msg.Id, part.PartId, attachmentExt(part, extOverrides))
 }
 
 func processPDFFile(srv *gmail.Service, userID string, part *gmail.MessagePart, msg *gmail.Message) error {
@@ -73,15 +204,15 @@ func processPDFFile(srv *gmail.Service, userID string, part *gmail.MessagePart,
 		return err
 	}
 
-	filename := constructFilename(part, msg)
+	filename := constructFilename(part, msg, nil)
 	f, err := os.OpenFile(filename, os.O_TRUNC|os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	// Decode base64 encoded data
-	fileContent, err := base64.URLEncoding.DecodeString(body.Data)
+	// Decode the body, whose transfer encoding Gmail has already reversed
+	fileContent, err := decodeBody(body, nil)
 	if err != nil {
 		return err
 	}
@@ -94,26 +225,88 @@ func processPDFFile(srv *gmail.Service, userID string, part *gmail.MessagePart,
 }
 
 func retrieveAttachment(srv *gmail.Service, userID string, msg *gmail.Message, body *gmail.MessagePartBody) (*gmail.MessagePartBody, error) {
-	if body.AttachmentId != "" {
+	// Gmail occasionally sends the data along with the attachment ID, sparing
+	// the request
+	if body.AttachmentId != "" && body.Data == "" {
 		// make a http request for the body
 		log.Printf("Requesting for attachment: %s\n", body.AttachmentId)
 		call := srv.Users.Messages.Attachments.Get(userID, msg.Id, body.AttachmentId)
-		return call.Do()
+		body, err := call.Do()
+		return body, quotaError(err)
 	}
 	return body, nil
 }
 
-func markAsRead(srv *gmail.Service, userID string, msgs []*gmail.Message) error {
+func markAsRead(ctx context.Context, srv *gmail.Service, userID string, msgs []*gmail.Message) error {
 	msgIds := make([]string, len(msgs))
 	for i, msg := range msgs {
 		msgIds[i] = msg.Id
 	}
+	return modifyLabels(ctx, srv, userID, msgIds, nil, []string{"UNREAD"})
+}
+
+// maxBatchModifyIds is the most message IDs Gmail accepts per batch modify
+const maxBatchModifyIds = 1000
+
+// modifyRetries is how many times a batch failing transiently is retried
+const modifyRetries = 3
+
+// modifyBackoff is the wait before the first retry of a batch, doubling with
+// each further attempt
+var modifyBackoff = time.Second
+
+// modifyLabels adds and removes labels on msgIds, in batches Gmail accepts.
+// Batches failing transiently are retried with exponential backoff; a batch
+// still failing doesn't stop the others, and its IDs are reported in a
+// ModifyError
+func modifyLabels(ctx context.Context, srv *gmail.Service, userID string, msgIds, add, remove []string) error {
+	var modErr *ModifyError
+	// Gmail rejects a batch modify without IDs, so empty chunks are never sent
+	for len(msgIds) > 0 {
+		n := len(msgIds)
+		if n > maxBatchModifyIds {
+			n = maxBatchModifyIds
+		}
+
+		req := &gmail.BatchModifyMessagesRequest{
+			Ids:            msgIds[:n],
+			AddLabelIds:    add,
+			RemoveLabelIds: remove,
+		}
+		if err := batchModify(ctx, srv, userID, req); err != nil {
+			if modErr == nil {
+				modErr = &ModifyError{}
+			}
+			modErr.MessageIDs = append(modErr.MessageIDs, req.Ids...)
+			modErr.Err = err
+		}
+		msgIds = msgIds[n:]
+	}
 
-	req := &gmail.BatchModifyMessagesRequest{
-		Ids:            msgIds,
-		RemoveLabelIds: []string{"UNREAD"},
+	if modErr != nil {
+		return modErr
 	}
+	return nil
+}
+
+// batchModify sends req, retrying transient failures
+func batchModify(ctx context.Context, srv *gmail.Service, userID string, req *gmail.BatchModifyMessagesRequest) error {
+	backoff := modifyBackoff
+	for attempt := 0; ; attempt++ {
+		call := srv.Users.Messages.BatchModify(userID, req).Context(ctx)
+		err := quotaError(call.Do())
+		if err == nil || attempt == modifyRetries || !isTransient(err) {
+			return err
+		}
 
-	call := srv.Users.Messages.BatchModify(userID, req)
-	return call.Do()
+		wait := backoff
+		var quotaErr *QuotaError
+		if errors.As(err, &quotaErr) && quotaErr.RetryAfter > wait {
+			wait = quotaErr.RetryAfter
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+		backoff *= 2
+	}
 }
@@ -0,0 +1,117 @@
+package gmail
+
+import (
+	"fmt"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestCaptureHeaders(t *testing.T) {
+	msg := &gmail.Message{Payload: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{
+		{Name: "From", Value: "reports@example.com"},
+		{Name: "Received", Value: "from mail.example.com"},
+		{Name: "Subject", Value: "report"},
+		{Name: "Message-ID", Value: "<1@example.com>"},
+		{Name: "Received", Value: "from relay.example.com"},
+	}}}
+
+	tests := []struct {
+		name  string
+		names []string
+		want  string
+	}{
+		{name: "none", want: "[]"},
+		{name: "subset", names: []string{"message-id", "FROM"}, want: "[From Message-ID]"},
+		{name: "repeated", names: []string{"Received"}, want: "[Received Received]"},
+		{name: "missing", names: []string{"Delivered-To"}, want: "[]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, header := range captureHeaders(msg, tt.names) {
+				got = append(got, header.Name)
+			}
+			if fmt.Sprint(got) != tt.want {
+				t.Errorf("captured %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeliveredTo(t *testing.T) {
+	header := func(name, value string) *gmail.MessagePartHeader {
+		return &gmail.MessagePartHeader{Name: name, Value: value}
+	}
+	tests := []struct {
+		name    string
+		headers []*gmail.MessagePartHeader
+		want    string
+	}{
+		{
+			name:    "several delivered to",
+			headers: []*gmail.MessagePartHeader{header("To", "team@example.com"), header("Delivered-To", "billing@example.com"), header("Delivered-To", "team@example.com")},
+			want:    "billing@example.com",
+		},
+		{name: "to", headers: []*gmail.MessagePartHeader{header("to", "billing@example.com")}, want: "billing@example.com"},
+		{name: "neither", headers: []*gmail.MessagePartHeader{header("From", "bank@example.com")}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &gmail.Message{Payload: &gmail.MessagePart{Headers: tt.headers}}
+			if got := deliveredTo(msg); got != tt.want {
+				t.Errorf("delivered to %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFrom(t *testing.T) {
+	tests := []struct {
+		header   string
+		wantAddr string
+		wantName string
+	}{
+		{header: `"Bank Statements" <statements@bank.example>`, wantAddr: "statements@bank.example", wantName: "Bank Statements"},
+		{header: "Reports <reports@example.com>", wantAddr: "reports@example.com", wantName: "Reports"},
+		{header: "reports@example.com", wantAddr: "reports@example.com"},
+		{header: "=?UTF-8?Q?Banque_F=C3=A9d=C3=A9rale?= <info@banque.example>", wantAddr: "info@banque.example", wantName: "Banque Fédérale"},
+		{header: "=?UTF-8?Q?Relev=C3=A9s?= not an address", wantAddr: "Relevés not an address"},
+		{header: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			addr, name := parseFrom(tt.header)
+			if addr != tt.wantAddr || name != tt.wantName {
+				t.Errorf("parsed %q, %q, want %q, %q", addr, name, tt.wantAddr, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestOriginalFilename(t *testing.T) {
+	tests := []struct {
+		name        string
+		filename    string
+		disposition string
+		want        string
+	}{
+		{name: "part filename", filename: "a.pdf", want: "a.pdf"},
+		{name: "disposition", disposition: `attachment; filename="b.pdf"`, want: "b.pdf"},
+		{name: "extended", disposition: `attachment; filename*=UTF-8''Relev%C3%A9%20mars.pdf`, want: "Relevé mars.pdf"},
+		{name: "disposition first", filename: "a.pdf", disposition: `attachment; filename="b.pdf"`, want: "b.pdf"},
+		{name: "no disposition filename", filename: "a.pdf", disposition: "attachment", want: "a.pdf"},
+		{name: "malformed", filename: "a.pdf", disposition: `attachment; filename="b.pdf`, want: "a.pdf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			part := &gmail.MessagePart{Filename: tt.filename}
+			if tt.disposition != "" {
+				part.Headers = []*gmail.MessagePartHeader{{Name: "Content-Disposition", Value: tt.disposition}}
+			}
+			if got := originalFilename(part); got != tt.want {
+				t.Errorf("filename = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// defaultMailboxConcurrency is used when Service.MailboxConcurrency isn't set
+const defaultMailboxConcurrency = 4
+
+// Result holds the outcome of processing a single mailbox
+type Result struct {
+	Attachments ProcessedAttachments
+	Stats       *Stats
+	// Err is the error that ended processing of the mailbox, if any
+	Err error
+}
+
+// MailboxErrors maps user IDs to the error processing their mailbox failed
+// with
+type MailboxErrors map[string]error
+
+func (e MailboxErrors) Error() string {
+	users := make([]string, 0, len(e))
+	for userID := range e {
+		users = append(users, userID)
+	}
+	sort.Strings(users)
+
+	msgs := make([]string, len(users))
+	for i, userID := range users {
+		msgs[i] = fmt.Sprintf("%s: %s", userID, e[userID])
+	}
+	return fmt.Sprintf("%d mailbox(es) failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// ForUser returns a copy of srv acting on behalf of userID, another mailbox
+// the service account is delegated for. Configuration, including writer
+// generators and LastRunStore, is shared; cached labels, Stats and the
+// Lockfile, which would keep copies from running alongside each other, aren't
+func (srv *Service) ForUser(userID string) (*Service, error) {
+	if srv.cnf == nil {
+		return nil, errors.New("service has no credentials to delegate")
+	}
+
+	clone := *srv
+	clone.UserID = userID
+	clone.labels = nil
+	clone.Stats = nil
+	clone.Lockfile = ""
+
+	cnf := *srv.cnf
+	cnf.Subject = userID
+	clone.cnf = &cnf
+
+	gmailSrv, client, err := newGmailService(clone.jwtSource, srv.opts)
+	if err != nil {
+		return nil, err
+	}
+	clone.srv = gmailSrv
+	clone.client = client
+	return &clone, nil
+}
+
+// ProcessMailboxes processes the mailboxes of userIDs concurrently, at most
+// MailboxConcurrency at a time, each with a service returned by ForUser. A
+// failing mailbox doesn't stop the others; their errors are returned
+// together as MailboxErrors, alongside the results of every mailbox.
+//
+// The mailboxes share the writer generators, so attachments should be written
+// somewhere unique to each, e.g. through a FilenameTemplate including the
+// message ID. The Lockfile, when set, is held once for all the mailboxes
+func (srv *Service) ProcessMailboxes(ctx context.Context, userIDs []string, markRead bool) (map[string]*Result, error) {
+	if srv.Lockfile != "" {
+		release, err := acquireLock(srv.Lockfile)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
+	concurrency := srv.MailboxConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultMailboxConcurrency
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]*Result, len(userIDs))
+	sem := make(chan struct{}, concurrency)
+	for _, userID := range userIDs {
+		wg.Add(1)
+		go func(userID string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			res := &Result{}
+			if user, err := srv.ForUser(userID); err != nil {
+				res.Err = err
+			} else {
+				res.Attachments, res.Err = user.ProcessPDFAttachmentsContext(ctx, markRead)
+				res.Stats = user.Stats
+			}
+
+			mu.Lock()
+			results[userID] = res
+			mu.Unlock()
+		}(userID)
+	}
+	wg.Wait()
+
+	errs := make(MailboxErrors)
+	for userID, res := range results {
+		if res.Err != nil {
+			errs[userID] = res.Err
+		}
+	}
+	if len(errs) > 0 {
+		return results, errs
+	}
+	return results, nil
+}
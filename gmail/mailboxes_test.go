@@ -0,0 +1,146 @@
+package gmail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2/jwt"
+	"google.golang.org/api/option"
+)
+
+func TestForUser(t *testing.T) {
+	srv := newTestService(&memFiles{})
+	srv.cnf = &jwt.Config{Email: "sa@example.com", Subject: "me@example.com"}
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	srv.Lockfile = filepath.Join(dir, "run.lock")
+	srv.labels = map[string]string{"Reports": "Label_1"}
+	srv.opts = []option.ClientOption{option.WithUserAgent("reports/1.0")}
+
+	user, err := srv.ForUser("other@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.UserID != "other@example.com" || user.cnf.Subject != "other@example.com" {
+		t.Errorf("user = %s, subject %s", user.UserID, user.cnf.Subject)
+	}
+	if srv.cnf.Subject != "me@example.com" {
+		t.Errorf("original subject changed to %s", srv.cnf.Subject)
+	}
+	if len(user.opts) != 1 {
+		t.Errorf("copy has client options %v, want those of the original", user.opts)
+	}
+	if user.Lockfile != "" || user.labels != nil || user.Stats != nil {
+		t.Errorf("copy kept lockfile %q, labels %v, stats %v", user.Lockfile, user.labels, user.Stats)
+	}
+}
+
+func TestProcessMailboxesLocked(t *testing.T) {
+	srv := newTestService(&memFiles{})
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	srv.Lockfile = filepath.Join(dir, "run.lock")
+	release, err := acquireLock(srv.Lockfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	if _, err := srv.ProcessMailboxes(context.Background(), []string{"a@example.com"}, false); !errors.Is(err, ErrLocked) {
+		t.Errorf("error = %v, want %v", err, ErrLocked)
+	}
+}
+
+// serviceAccountJSON returns the key file of a service account whose tokens
+// are obtained from tokenURL
+func serviceAccountJSON(t *testing.T, tokenURL string) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "sa@example.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		"token_uri":    tokenURL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestProcessMailboxes(t *testing.T) {
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	mailboxes := map[string]*fakeGmail{
+		"a@example.com": newFakeGmail(pdfMessage("a1", date, "a.pdf"), pdfMessage("a2", date, "b.pdf")),
+		"b@example.com": newFakeGmail(pdfMessage("b1", date, "c.pdf")),
+	}
+	for _, fake := range mailboxes {
+		defer fake.Close()
+	}
+	// route each mailbox to its fake, as the user it belongs to
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token":"token","token_type":"Bearer","expires_in":3600}`))
+			return
+		}
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/gmail/v1/users/"), "/", 2)
+		fake, ok := mailboxes[parts[0]]
+		if !ok || len(parts) < 2 {
+			http.NotFound(w, r)
+			return
+		}
+		r.URL.Path = "/gmail/v1/users/me/" + parts[1]
+		fake.serve(w, r)
+	}))
+	defer server.Close()
+
+	config := bytes.NewReader(serviceAccountJSON(t, server.URL+"/token"))
+	srv, err := NewService(config, "admin@example.com", option.WithEndpoint(server.URL+"/gmail/v1/users/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := &memFiles{}
+	srv.WriterGenerator = files.generator
+
+	results, err := srv.ProcessMailboxes(context.Background(), []string{"a@example.com", "b@example.com", "c@example.com"}, true)
+	var errs MailboxErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs["c@example.com"] == nil {
+		t.Errorf("err = %v, want the failure of c@example.com", err)
+	}
+	for userID, want := range map[string]string{"a@example.com": "[a1 a2]", "b@example.com": "[b1]"} {
+		res := results[userID]
+		if res.Err != nil {
+			t.Errorf("%s: %v", userID, res.Err)
+			continue
+		}
+		var ids []string
+		for _, att := range res.Attachments {
+			ids = append(ids, att.MessageID)
+		}
+		if got := fmt.Sprint(ids); got != want || res.Stats.Messages != len(ids) {
+			t.Errorf("%s processed %s, %d messages, want %s", userID, got, res.Stats.Messages, want)
+		}
+		if got := fmt.Sprint(mailboxes[userID].markedRead()); got != want {
+			t.Errorf("%s marked %s as read, want %s", userID, got, want)
+		}
+	}
+	if got, want := fmt.Sprint(files.names()), "[a.pdf-a1-0.pdf b.pdf-a2-0.pdf c.pdf-b1-0.pdf]"; got != want {
+		t.Errorf("wrote %s, want %s", got, want)
+	}
+}
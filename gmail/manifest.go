@@ -0,0 +1,102 @@
+package gmail
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// sidecarExt is appended to an attachment's filename to name its sidecar
+const sidecarExt = ".json"
+
+// sidecar is the metadata written next to an attachment
+type sidecar struct {
+	MessageID    string                     `json:"message_id"`
+	ThreadID     string                     `json:"thread_id,omitempty"`
+	Filename     string                     `json:"filename"`
+	OriginalName string                     `json:"original_name"`
+	MimeType     string                     `json:"mime_type"`
+	Size         int64                      `json:"size"`
+	SHA256       string                     `json:"sha256"`
+	From         string                     `json:"from"`
+	FromName     string                     `json:"from_name,omitempty"`
+	Subject      string                     `json:"subject,omitempty"`
+	Date         time.Time                  `json:"date"`
+	Headers      []*gmail.MessagePartHeader `json:"headers,omitempty"`
+}
+
+// csvHeader names the columns written by WriteCSV
+var csvHeader = []string{
+	"message_id", "filename", "original_name", "mime_type", "size", "sha256", "date", "from",
+}
+
+// WriteCSV writes an inventory of the attachments to w as CSV with a header
+// row. Dates are formatted as RFC 3339 and left empty when unknown
+func (at ProcessedAttachments) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+
+	for _, a := range at {
+		date := ""
+		if !a.Date.IsZero() {
+			date = a.Date.Format(time.RFC3339)
+		}
+		record := []string{
+			a.MessageID,
+			a.Filename,
+			a.OriginalName,
+			a.MimeType,
+			strconv.FormatInt(a.Size, 10),
+			a.SHA256,
+			date,
+			a.From,
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeSidecar writes the attachment's metadata as JSON using the configured
+// generator, naming it after the attachment with a .json extension
+func (srv *Service) writeSidecar(ctx context.Context, att *ProcessedAttachment) error {
+	side := *att
+	side.Filename += sidecarExt
+	side.MimeType = "application/json"
+	side.Body = nil
+
+	w, err := srv.newWriter(ctx, &side)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(w).Encode(sidecar{
+		MessageID:    att.MessageID,
+		ThreadID:     att.ThreadID,
+		Filename:     att.Filename,
+		OriginalName: att.OriginalName,
+		MimeType:     att.MimeType,
+		Size:         att.Size,
+		SHA256:       att.SHA256,
+		From:         att.From,
+		FromName:     att.FromName,
+		Subject:      att.Subject,
+		Date:         att.Date,
+		Headers:      att.Headers,
+	})
+	if closer, ok := w.(io.Closer); ok {
+		if cerr := closer.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
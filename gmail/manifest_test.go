@@ -0,0 +1,89 @@
+package gmail
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestWriteCSV(t *testing.T) {
+	atts := ProcessedAttachments{
+		{
+			MessageID:    "m1",
+			Filename:     "m1/statement, jan.pdf",
+			OriginalName: `statement "jan".pdf`,
+			MimeType:     "application/pdf",
+			Size:         1024,
+			SHA256:       "abc123",
+			Date:         time.Date(2020, 1, 2, 10, 0, 0, 0, time.FixedZone("EAT", 3*60*60)),
+			From:         "reports@example.com",
+		},
+		{MessageID: "m2", Filename: "b.pdf", OriginalName: "b.pdf", MimeType: "application/pdf"},
+	}
+	var out bytes.Buffer
+	if err := atts.WriteCSV(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		csvHeader,
+		{"m1", "m1/statement, jan.pdf", `statement "jan".pdf`, "application/pdf", "1024", "abc123", "2020-01-02T10:00:00+03:00", "reports@example.com"},
+		{"m2", "b.pdf", "b.pdf", "application/pdf", "0", "", "", ""},
+	}
+	if fmt.Sprintf("%q", records) != fmt.Sprintf("%q", want) {
+		t.Errorf("records\n%q\nwant\n%q", records, want)
+	}
+}
+
+func TestWriteSidecar(t *testing.T) {
+	date := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+	msg := pdfMessage("m1", date, "a.pdf")
+	msg.Payload.Headers = append(msg.Payload.Headers, &gmail.MessagePartHeader{Name: "Date", Value: "Thu, 02 Jan 2020 10:00:00 +0000"})
+	files := &memFiles{}
+	srv := newTestService(files, msg)
+	srv.WriteSidecar = true
+	srv.CaptureHeaders = []string{"subject"}
+	if _, _, err := srv.processMessages(context.Background(), listed(msg), false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(files.names()), "[a.pdf-m1-0.pdf a.pdf-m1-0.pdf.json]"; got != want {
+		t.Fatalf("wrote %s, want %s", got, want)
+	}
+
+	var side map[string]interface{}
+	if err := json.Unmarshal(files.files["a.pdf-m1-0.pdf.json"].Bytes(), &side); err != nil {
+		t.Fatal(err)
+	}
+	content := "%PDF-1.4 m1/a.pdf"
+	sum := sha256.Sum256([]byte(content))
+	want := map[string]interface{}{
+		"message_id":    "m1",
+		"thread_id":     "thread-m1",
+		"filename":      "a.pdf-m1-0.pdf",
+		"original_name": "a.pdf",
+		"mime_type":     "application/pdf",
+		"size":          float64(len(content)),
+		"sha256":        hex.EncodeToString(sum[:]),
+		"from":          "reports@example.com",
+		"from_name":     "Reports",
+		"subject":       "report m1",
+		"date":          "2020-01-02T10:00:00Z",
+		"headers":       []interface{}{map[string]interface{}{"name": "Subject", "value": "report m1"}},
+	}
+	if !reflect.DeepEqual(side, want) {
+		t.Errorf("sidecar\n%v\nwant\n%v", side, want)
+	}
+}
@@ -0,0 +1,58 @@
+package gmail
+
+import (
+	"time"
+)
+
+// Error kinds reported to Metrics.IncErrors
+const (
+	ErrorKindRetrieve = "retrieve"
+	ErrorKindProcess  = "process"
+	ErrorKindWrite    = "write"
+	ErrorKindMarkRead = "mark_read"
+)
+
+// Metrics receives instrumentation from a run. Implementations may be called
+// from several goroutines.
+//
+// A Prometheus backed implementation would hold counters for messages,
+// attachments, bytes and errors (labelled by kind) and a histogram for fetch
+// durations, registered once and incremented from these methods:
+//
+//	func (m *promMetrics) IncBytes(n int64) { m.bytes.Add(float64(n)) }
+//	func (m *promMetrics) ObserveFetchDuration(d time.Duration) {
+//		m.fetch.Observe(d.Seconds())
+//	}
+type Metrics interface {
+	IncMessages(n int)
+	IncAttachments(n int)
+	IncBytes(n int64)
+	ObserveFetchDuration(d time.Duration)
+	IncErrors(kind string)
+}
+
+// NopMetrics discards all instrumentation. It is the default
+type NopMetrics struct{}
+
+// IncMessages does nothing
+func (NopMetrics) IncMessages(n int) {}
+
+// IncAttachments does nothing
+func (NopMetrics) IncAttachments(n int) {}
+
+// IncBytes does nothing
+func (NopMetrics) IncBytes(n int64) {}
+
+// ObserveFetchDuration does nothing
+func (NopMetrics) ObserveFetchDuration(d time.Duration) {}
+
+// IncErrors does nothing
+func (NopMetrics) IncErrors(kind string) {}
+
+// metrics returns srv.Metrics, defaulting to NopMetrics
+func (srv *Service) metrics() Metrics {
+	if srv.Metrics == nil {
+		return NopMetrics{}
+	}
+	return srv.Metrics
+}
@@ -0,0 +1,80 @@
+package gmail
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingMetrics counts the instrumentation it receives
+type recordingMetrics struct {
+	mu                    sync.Mutex
+	messages, attachments int
+	bytes                 int64
+	fetches               int
+	errors                map[string]int
+}
+
+func (m *recordingMetrics) IncMessages(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages += n
+}
+
+func (m *recordingMetrics) IncAttachments(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.attachments += n
+}
+
+func (m *recordingMetrics) IncBytes(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytes += n
+}
+
+func (m *recordingMetrics) ObserveFetchDuration(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fetches++
+}
+
+func (m *recordingMetrics) IncErrors(kind string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.errors == nil {
+		m.errors = make(map[string]int)
+	}
+	m.errors[kind]++
+}
+
+func TestMetrics(t *testing.T) {
+	if _, ok := (&Service{}).metrics().(NopMetrics); !ok {
+		t.Error("unset metrics aren't NopMetrics")
+	}
+	fake := newFakeGmail()
+	defer fake.Close()
+	if _, ok := fake.service(t, &memFiles{}).Metrics.(NopMetrics); !ok {
+		t.Error("new services don't default to NopMetrics")
+	}
+
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	broken := pdfMessage("broken", date, "b.pdf")
+	broken.Payload.Parts[0].Body.Data = "not base64!"
+	good := pdfMessage("good", date, "a.pdf", "c.pdf")
+	srv := newTestService(&memFiles{}, good, broken)
+	metrics := &recordingMetrics{}
+	srv.Metrics = metrics
+	if _, _, err := srv.processMessages(context.Background(), listed(good, broken), false); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "messages 1, attachments 2, bytes 38, fetches 2, errors map[process:1]"
+	got := fmt.Sprintf("messages %d, attachments %d, bytes %d, fetches %d, errors %v",
+		metrics.messages, metrics.attachments, metrics.bytes, metrics.fetches, metrics.errors)
+	if got != want {
+		t.Errorf("recorded %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,113 @@
+package gmail
+
+import (
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// fallbackContentType is used when the content type can't be determined
+const fallbackContentType = "application/octet-stream"
+
+// defaultMimeType is matched when Service.AcceptMimeTypes is empty
+const defaultMimeType = "application/pdf"
+
+// mimeMatches reports whether the actual MIME type matches pattern, which may
+// be a full type, a type/* wildcard or */*. Matching is case-insensitive and
+// ignores parameters
+func mimeMatches(pattern, actual string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	actual = strings.ToLower(strings.TrimSpace(actual))
+	if i := strings.IndexByte(actual, ';'); i >= 0 {
+		actual = strings.TrimSpace(actual[:i])
+	}
+
+	if pattern == "*/*" || pattern == "*" {
+		return actual != ""
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(actual, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == actual
+}
+
+// acceptsMimeType reports whether parts of the MIME type are to be processed.
+// Multipart containers are never accepted so wildcards don't stop their parts
+// from being walked
+func (srv *Service) acceptsMimeType(mimeType string) bool {
+	_, ok := srv.matchMimeType(mimeType)
+	return ok
+}
+
+// matchMimeType returns the accepted pattern the MIME type matches
+func (srv *Service) matchMimeType(mimeType string) (string, bool) {
+	if strings.HasPrefix(strings.ToLower(mimeType), "multipart/") {
+		return "", false
+	}
+	if len(srv.AcceptMimeTypes) == 0 {
+		return defaultMimeType, mimeMatches(defaultMimeType, mimeType)
+	}
+	for _, pattern := range srv.AcceptMimeTypes {
+		if mimeMatches(pattern, mimeType) {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// DefaultExtensionOverrides are the preferred extensions of common MIME
+// types for which mime.ExtensionsByType may return an unusual one first
+var DefaultExtensionOverrides = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/tiff":      ".tiff",
+	"text/plain":      ".txt",
+	"text/html":       ".html",
+	"audio/mpeg":      ".mp3",
+	"video/mpeg":      ".mpeg",
+	"application/zip": ".zip",
+}
+
+// attachmentExt returns the extension used when naming the part's file.
+// Without an original extension, overrides and then DefaultExtensionOverrides
+// are consulted before the registered extensions of the MIME type
+func attachmentExt(part *gmail.MessagePart, overrides map[string]string) string {
+	if mimeMatches(defaultMimeType, part.MimeType) {
+		return ".pdf"
+	}
+	if ext := filepath.Ext(originalFilename(part)); ext != "" {
+		return ext
+	}
+	mimeType := strings.ToLower(strings.TrimSpace(part.MimeType))
+	if i := strings.IndexByte(mimeType, ';'); i >= 0 {
+		mimeType = strings.TrimSpace(mimeType[:i])
+	}
+	if ext, ok := overrides[mimeType]; ok {
+		return ext
+	}
+	if ext, ok := DefaultExtensionOverrides[mimeType]; ok {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(part.MimeType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// DetectContentType returns the content type of an attachment, preferring the
+// type registered for the filename's extension and otherwise sniffing the
+// first bytes of its contents. Generators uploading to object stores can use
+// it to set the object's metadata. It defaults to application/octet-stream
+func DetectContentType(filename string, sniffedBytes []byte) string {
+	if ext := filepath.Ext(filename); ext != "" {
+		if contentType := mime.TypeByExtension(ext); contentType != "" {
+			return contentType
+		}
+	}
+	if len(sniffedBytes) > 0 {
+		return http.DetectContentType(sniffedBytes)
+	}
+	return fallbackContentType
+}
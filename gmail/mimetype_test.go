@@ -0,0 +1,70 @@
+package gmail
+
+import (
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestMimeMatches(t *testing.T) {
+	tests := []struct {
+		pattern, actual string
+		want            bool
+	}{
+		{pattern: "application/pdf", actual: "application/pdf", want: true},
+		{pattern: "application/pdf", actual: "Application/PDF; name=a.pdf", want: true},
+		{pattern: "image/*", actual: "image/png", want: true},
+		{pattern: "image/*", actual: "imagex/png", want: false},
+		{pattern: "*/*", actual: "text/csv", want: true},
+		{pattern: "*/*", actual: "", want: false},
+		{pattern: "application/pdf", actual: "application/pdfx", want: false},
+	}
+	for _, tt := range tests {
+		if got := mimeMatches(tt.pattern, tt.actual); got != tt.want {
+			t.Errorf("mimeMatches(%q, %q) = %t, want %t", tt.pattern, tt.actual, got, tt.want)
+		}
+	}
+}
+
+func TestAttachmentExt(t *testing.T) {
+	tests := []struct {
+		name      string
+		part      *gmail.MessagePart
+		overrides map[string]string
+		want      string
+	}{
+		{name: "pdf", part: &gmail.MessagePart{MimeType: "application/pdf", Filename: "a.PDF"}, want: ".pdf"},
+		{name: "original", part: &gmail.MessagePart{MimeType: "image/jpeg", Filename: "a.jpeg"}, want: ".jpeg"},
+		{name: "default override", part: &gmail.MessagePart{MimeType: "image/jpeg"}, want: ".jpg"},
+		{name: "override", part: &gmail.MessagePart{MimeType: "image/jpeg; name=x"}, overrides: map[string]string{"image/jpeg": ".jpe"}, want: ".jpe"},
+		{name: "unknown", part: &gmail.MessagePart{MimeType: "application/x-unknown-type"}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := attachmentExt(tt.part, tt.overrides); got != tt.want {
+				t.Errorf("ext = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	tests := []struct {
+		filename string
+		sniffed  []byte
+		want     string
+	}{
+		{filename: "a.pdf", want: "application/pdf"},
+		{filename: "a", sniffed: []byte("%PDF-1.4"), want: "application/pdf"},
+		{filename: "a"},
+	}
+	for _, tt := range tests {
+		want := tt.want
+		if want == "" {
+			want = fallbackContentType
+		}
+		if got := DetectContentType(tt.filename, tt.sniffed); got != want {
+			t.Errorf("DetectContentType(%q) = %q, want %q", tt.filename, got, want)
+		}
+	}
+}
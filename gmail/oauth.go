@@ -0,0 +1,139 @@
+package gmail
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/oauth2"
+)
+
+// BootstrapOAuth creates a service acting as the user who authorises config,
+// for individuals without a service account. A token cached at tokenPath is
+// reused; otherwise the loopback flow is run: the consent URL is passed to
+// prompt, or printed to standard error when prompt is nil, and a local server
+// awaits the redirect, after which the token is cached. config must belong to
+// a desktop OAuth client; its RedirectURL is set to the local server
+func BootstrapOAuth(ctx context.Context, config *oauth2.Config, tokenPath string, prompt func(authURL string)) (*Service, error) {
+	token, err := readToken(tokenPath)
+	if err != nil {
+		if prompt == nil {
+			prompt = printPrompt
+		}
+		if token, err = loopbackToken(ctx, config, prompt); err != nil {
+			return nil, err
+		}
+		if err := writeToken(tokenPath, token); err != nil {
+			return nil, err
+		}
+	}
+
+	// after the first, sources only hold the refresh token so a new access
+	// token is obtained
+	first := true
+	return newTokenService(func() oauth2.TokenSource {
+		if first {
+			first = false
+			return config.TokenSource(ctx, token)
+		}
+		return config.TokenSource(ctx, &oauth2.Token{RefreshToken: token.RefreshToken})
+	}, "me", nil)
+}
+
+// readToken reads a token cached by writeToken
+func readToken(path string) (*oauth2.Token, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	token := &oauth2.Token{}
+	if err := json.Unmarshal(data, token); err != nil {
+		return nil, err
+	}
+	if token.RefreshToken == "" && !token.Valid() {
+		return nil, errors.New("cached token expired")
+	}
+	return token, nil
+}
+
+// writeToken caches token at path, readable only by the user
+func writeToken(path string, token *oauth2.Token) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// printPrompt asks the user to visit authURL on standard error
+func printPrompt(authURL string) {
+	fmt.Fprintf(os.Stderr, "Authorise access by visiting:\n%s\n", authURL)
+}
+
+// loopbackToken obtains a token by sending the user to the consent page
+// through prompt and receiving the authorisation code on a local server
+func loopbackToken(ctx context.Context, config *oauth2.Config, prompt func(authURL string)) (*oauth2.Token, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	state := hex.EncodeToString(b)
+
+	cnf := *config
+	cnf.RedirectURL = "http://" + l.Addr().String() + "/"
+
+	codes := make(chan string, 1)
+	errs := make(chan error, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("state") != state {
+			http.Error(w, "invalid state", http.StatusBadRequest)
+			return
+		}
+		if msg := q.Get("error"); msg != "" {
+			http.Error(w, "authorisation failed", http.StatusForbidden)
+			select {
+			case errs <- fmt.Errorf("authorisation failed: %s", msg):
+			default:
+			}
+			return
+		}
+		fmt.Fprintln(w, "Authorised, you may close this window.")
+		select {
+		case codes <- q.Get("code"):
+		default:
+		}
+	})}
+	go server.Serve(l)
+	defer server.Close()
+
+	prompt(cnf.AuthCodeURL(state, oauth2.AccessTypeOffline))
+
+	select {
+	case code := <-codes:
+		return cnf.Exchange(ctx, code)
+	case err := <-errs:
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
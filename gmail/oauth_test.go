@@ -0,0 +1,73 @@
+package gmail
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestBootstrapOAuth(t *testing.T) {
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "granted" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"access","refresh_token":"refresh","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer tokenServer.Close()
+	config := &oauth2.Config{
+		ClientID: "client",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://accounts.example.com/auth", TokenURL: tokenServer.URL},
+	}
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	tokenPath := filepath.Join(dir, "token.json")
+
+	// consent redirects back to the local server with query, and the
+	// state it was given
+	consent := func(query string) func(string) {
+		return func(authURL string) {
+			u, err := url.Parse(authURL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			q := u.Query()
+			go http.Get(q.Get("redirect_uri") + "?state=" + q.Get("state") + "&" + query)
+		}
+	}
+
+	if _, err := BootstrapOAuth(context.Background(), config, tokenPath, consent("error=access_denied")); err == nil || !strings.Contains(err.Error(), "access_denied") {
+		t.Errorf("err = %v, want the denial", err)
+	}
+	if _, err := readToken(tokenPath); err == nil {
+		t.Error("cached a token that was denied")
+	}
+
+	if _, err := BootstrapOAuth(context.Background(), config, tokenPath, consent("code=granted")); err != nil {
+		t.Fatal(err)
+	}
+	token, err := readToken(tokenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "access" || token.RefreshToken != "refresh" {
+		t.Errorf("cached token %+v", token)
+	}
+
+	// the cached token is reused without prompting
+	prompted := false
+	if _, err := BootstrapOAuth(context.Background(), config, tokenPath, func(string) { prompted = true }); err != nil {
+		t.Fatal(err)
+	}
+	if prompted {
+		t.Error("prompted despite the cached token")
+	}
+}
@@ -0,0 +1,65 @@
+package gmail
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// pushRequest is the body of a Pub/Sub push request
+type pushRequest struct {
+	Message struct {
+		Data string `json:"data"`
+	} `json:"message"`
+}
+
+// pushNotification is the data Gmail publishes when a watched mailbox changes
+type pushNotification struct {
+	EmailAddress string    `json:"emailAddress"`
+	HistoryID    historyID `json:"historyId"`
+}
+
+// historyID is a history ID which Gmail documents as a string but has been
+// seen sent as a number
+type historyID uint64
+
+func (id *historyID) UnmarshalJSON(data []byte) error {
+	n, err := strconv.ParseUint(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid historyId %s", data)
+	}
+	*id = historyID(n)
+	return nil
+}
+
+// ParsePushNotification decodes the body of a Pub/Sub push request Gmail sent
+// for a watched mailbox, returning the mailbox address and the history ID it
+// changed at
+func ParsePushNotification(body []byte) (emailAddress string, historyID uint64, err error) {
+	var req pushRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return "", 0, err
+	}
+	if req.Message.Data == "" {
+		return "", 0, errors.New("push request carries no data")
+	}
+	// Pub/Sub encodes data with the standard alphabet, Gmail's documentation
+	// with the URL safe one, with or without padding
+	encoding := base64.RawStdEncoding
+	if strings.ContainsAny(req.Message.Data, "-_") {
+		encoding = base64.RawURLEncoding
+	}
+	data, err := encoding.DecodeString(strings.TrimRight(req.Message.Data, "="))
+	if err != nil {
+		return "", 0, err
+	}
+
+	var n pushNotification
+	if err := json.Unmarshal(data, &n); err != nil {
+		return "", 0, err
+	}
+	return n.EmailAddress, uint64(n.HistoryID), nil
+}
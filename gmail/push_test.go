@@ -0,0 +1,48 @@
+package gmail
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestParsePushNotification(t *testing.T) {
+	pushBody := func(data string) []byte {
+		return []byte(`{"message":{"data":"` + data + `","messageId":"1"},"subscription":"projects/p/subscriptions/s"}`)
+	}
+	stringID := `{"emailAddress":"user@example.com","historyId":"9876543210"}`
+	numberID := `{"emailAddress":"user@example.com","historyId":9876543210}`
+	// chosen so the URL safe encoding differs from the standard one
+	urlSafe := `{"emailAddress":"a??>?@example.com","historyId":"9876543210"}`
+
+	tests := []struct {
+		name      string
+		body      []byte
+		wantEmail string
+		wantErr   bool
+	}{
+		{name: "string history ID", body: pushBody(base64.StdEncoding.EncodeToString([]byte(stringID))), wantEmail: "user@example.com"},
+		{name: "number history ID", body: pushBody(base64.StdEncoding.EncodeToString([]byte(numberID))), wantEmail: "user@example.com"},
+		{name: "base64url", body: pushBody(base64.URLEncoding.EncodeToString([]byte(urlSafe))), wantEmail: "a??>?@example.com"},
+		{name: "unpadded base64url", body: pushBody(base64.RawURLEncoding.EncodeToString([]byte(urlSafe))), wantEmail: "a??>?@example.com"},
+		{name: "invalid history ID", body: pushBody(base64.StdEncoding.EncodeToString([]byte(`{"historyId":"x"}`))), wantErr: true},
+		{name: "no data", body: []byte(`{"message":{}}`), wantErr: true},
+		{name: "not JSON", body: []byte(`<html>`), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			email, historyID, err := ParsePushNotification(tt.body)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if email != tt.wantEmail || historyID != 9876543210 {
+				t.Errorf("got %s, %d", email, historyID)
+			}
+		})
+	}
+}
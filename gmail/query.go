@@ -0,0 +1,72 @@
+package gmail
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lastRunOverlap is subtracted from the last run time so messages aren't
+// missed where Gmail only honours the day of an after: search
+const lastRunOverlap = 24 * time.Hour
+
+// LastRunStore persists the time of the last completed run
+type LastRunStore interface {
+	// Get returns the time of the last run, the zero time if there was none
+	Get() (time.Time, error)
+	Set(time.Time) error
+}
+
+// querySpecialChars are characters that change the meaning of a Gmail search
+// value unless it is quoted
+const querySpecialChars = " \t\"(){}[]+-:,*"
+
+// quoteQueryValue wraps value in double quotes when it contains whitespace or
+// characters with a special meaning in Gmail queries, escaping embedded quotes
+func quoteQueryValue(value string) string {
+	if value == "" || !strings.ContainsAny(value, querySpecialChars) {
+		return value
+	}
+	return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+}
+
+// queryTerm builds an operator:value search term e.g. from:"jo+reports@x.com"
+func queryTerm(operator, value string) string {
+	return operator + ":" + quoteQueryValue(value)
+}
+
+// EffectiveQuery returns the search query ListMessages sends, DefaultQ
+// combined with the search terms enabled on the service, without calling
+// Gmail. It helps troubleshoot why nothing matched
+func (srv *Service) EffectiveQuery() (string, error) {
+	return srv.query()
+}
+
+// query composes DefaultQ with the search terms enabled on the service. The
+// terms are all required; DefaultQ is parenthesised when combined so an OR
+// within it doesn't swallow them
+func (srv *Service) query() (string, error) {
+	terms := make([]string, 0, 2)
+	if srv.Category != AnyCategory {
+		terms = append(terms, queryTerm("category", string(srv.Category)))
+	}
+
+	if srv.LastRunStore != nil {
+		last, err := srv.LastRunStore.Get()
+		if err != nil {
+			return "", err
+		}
+		if !last.IsZero() {
+			after := last.Add(-lastRunOverlap).Unix()
+			terms = append(terms, queryTerm("after", strconv.FormatInt(after, 10)))
+		}
+	}
+
+	if srv.DefaultQ == "" {
+		return strings.Join(terms, " "), nil
+	}
+	if len(terms) == 0 {
+		return srv.DefaultQ, nil
+	}
+	return "(" + srv.DefaultQ + ") " + strings.Join(terms, " "), nil
+}
@@ -0,0 +1,75 @@
+package gmail
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// lastRun is a LastRunStore held in memory
+type lastRun struct {
+	last time.Time
+	err  error
+}
+
+func (l *lastRun) Get() (time.Time, error) { return l.last, l.err }
+
+func (l *lastRun) Set(t time.Time) error {
+	l.last = t
+	return nil
+}
+
+func TestQuoteQueryValue(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{value: "", want: ""},
+		{value: "reports@example.com", want: "reports@example.com"},
+		{value: "jo+reports@example.com", want: `"jo+reports@example.com"`},
+		{value: "two words", want: `"two words"`},
+		{value: `say "hi"`, want: `"say \"hi\""`},
+	}
+	for _, tt := range tests {
+		if got := quoteQueryValue(tt.value); got != tt.want {
+			t.Errorf("quoteQueryValue(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestEffectiveQuery(t *testing.T) {
+	last := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		defaultQ string
+		category Category
+		store    LastRunStore
+		want     string
+	}{
+		{name: "empty"},
+		{name: "default", defaultQ: "has:attachment", want: "has:attachment"},
+		{name: "category", category: Promotions, want: "category:promotions"},
+		{name: "combined", defaultQ: "from:a OR from:b", category: Primary, want: "(from:a OR from:b) category:primary"},
+		{name: "no last run", defaultQ: "has:attachment", store: &lastRun{}, want: "has:attachment"},
+		{name: "last run", store: &lastRun{last: last}, want: "after:1577836800"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &Service{DefaultQ: tt.defaultQ, Category: tt.category, LastRunStore: tt.store}
+			got, err := srv.EffectiveQuery()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("query = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("store error", func(t *testing.T) {
+		errStore := errors.New("unreadable")
+		srv := &Service{LastRunStore: &lastRun{err: errStore}}
+		if _, err := srv.EffectiveQuery(); err != errStore {
+			t.Errorf("err = %v, want %v", err, errStore)
+		}
+	})
+}
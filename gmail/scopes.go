@@ -0,0 +1,80 @@
+package gmail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+)
+
+// tokenInfoURL is Google's endpoint describing an access token
+const tokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+
+// requiredScopes are the scopes needed to read attachments and mark messages
+// as read
+var requiredScopes = []string{gmail.GmailReadonlyScope, gmail.GmailModifyScope}
+
+// CheckScopes verifies the credentials have been granted the scopes needed by
+// the service, returning an error listing any that are missing.
+//
+// It obtains an access token and asks Google's tokeninfo endpoint which scopes
+// the token carries. With domain-wide delegation, a scope the service account
+// isn't authorised for usually fails the token request itself, in which case
+// that error is returned
+func (srv *Service) CheckScopes(ctx context.Context) error {
+	if srv.cnf == nil {
+		return errors.New("check scopes: service has no JWT config")
+	}
+	return checkScopes(ctx, srv.cnf.TokenSource(ctx), http.DefaultClient, tokenInfoURL)
+}
+
+// checkScopes verifies a token from ts carries requiredScopes, asking the
+// tokeninfo endpoint at infoURL through client
+func checkScopes(ctx context.Context, ts oauth2.TokenSource, client *http.Client, infoURL string) error {
+	token, err := ts.Token()
+	if err != nil {
+		return fmt.Errorf("check scopes: %w", err)
+	}
+
+	u := infoURL + "?" + url.Values{"access_token": {token.AccessToken}}.Encode()
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("check scopes: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("check scopes: tokeninfo returned %s", res.Status)
+	}
+
+	var info struct {
+		Scope string `json:"scope"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return fmt.Errorf("check scopes: %w", err)
+	}
+
+	granted := make(map[string]bool)
+	for _, scope := range strings.Fields(info.Scope) {
+		granted[scope] = true
+	}
+	missing := make([]string, 0)
+	for _, scope := range requiredScopes {
+		if !granted[scope] {
+			missing = append(missing, scope)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("check scopes: missing %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
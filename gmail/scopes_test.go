@@ -0,0 +1,54 @@
+package gmail
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestCheckScopes(t *testing.T) {
+	scopes := map[string]string{
+		"full":    gmail.GmailReadonlyScope + " " + gmail.GmailModifyScope,
+		"partial": gmail.GmailReadonlyScope,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope, ok := scopes[r.URL.Query().Get("access_token")]
+		if !ok {
+			http.Error(w, `{"error":"invalid_token"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"scope": scope})
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		token   string
+		wantErr string
+	}{
+		{token: "full"},
+		{token: "partial", wantErr: "missing " + gmail.GmailModifyScope},
+		{token: "revoked", wantErr: "400 Bad Request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			src := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: tt.token})
+			err := checkScopes(context.Background(), src, ts.Client(), ts.URL)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("err = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+
+	if err := (&Service{}).CheckScopes(context.Background()); err == nil {
+		t.Error("checked the scopes of a service without credentials")
+	}
+}
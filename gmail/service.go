@@ -1,12 +1,22 @@
 package gmail
 
 import (
+	"bytes"
 	"context"
-	"encoding/base64"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
+	"text/template"
+	"time"
 
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"golang.org/x/oauth2/jwt"
 	"google.golang.org/api/gmail/v1"
@@ -21,21 +31,220 @@ type Service struct {
 	cnf    *jwt.Config
 	UserID string
 	srv    *gmail.Service
+	// client sends the requests made to Gmail
+	client *http.Client
 	// DefaultQ  is provided when filtering messages Gmail search box style
-	DefaultQ        string
+	DefaultQ string
+	// LabelIDs restricts listed messages to those carrying all the labels
+	LabelIDs []string
+	// RequireLabelIDs skips retrieved messages lacking any of the labels,
+	// leaving them unread, for filters the search query can't express. The
+	// labels must be kept by FieldMask.Get
+	RequireLabelIDs []string
+	// Folder restricts listed messages to a system folder, in addition to
+	// LabelIDs. Defaults to AllMail
+	Folder Folder
+	// Category restricts listed messages to an inbox tab. Tabs are only
+	// assigned to messages in the inbox of accounts using them. Defaults to
+	// AnyCategory
+	Category        Category
 	WriterGenerator WriterGenerator
+	// AttachmentWriterGenerator takes precedence over WriterGenerator when set
+	AttachmentWriterGenerator AttachmentWriterGenerator
+	// OnWriterError determines what happens when WriterGenerator fails.
+	// Defaults to Skip
+	OnWriterError WriterErrorPolicy
+	// WriterRetries is the number of times WriterGenerator is re-invoked
+	// when OnWriterError is Retry, waiting a second before the first retry
+	// and twice as long before each further one
+	WriterRetries int
+	// FilenameTemplate, when set, names attachments by executing it against
+	// the *ProcessedAttachment being written e.g.
+	// {{.Date.Format "2006-01"}}/{{.FromName}}/{{.OriginalName}}. Path
+	// separators create sub directories, "." and ".." segments are dropped
+	FilenameTemplate *template.Template
+	// ContentAddressed names attachments by the hex SHA256 of their content
+	// and their extension, e.g. <hash>.pdf, taking precedence over
+	// FilenameTemplate and Dedup. Identical attachments share a name, so
+	// stores deduplicating by name keep a single copy
+	ContentAddressed bool
+	// ExtensionOverrides maps MIME types to the extension given to files
+	// named without an original extension, taking precedence over
+	// DefaultExtensionOverrides and the registered extensions
+	ExtensionOverrides map[string]string
+	// Dedup changes filenames already used earlier in the run, regardless
+	// of where attachments are written. Defaults to NoDedup
+	Dedup DedupStrategy
+	// OCR, when set, extracts the text of each PDF attachment, e.g. with
+	// Tesseract, before it is written. The text is stored on
+	// ProcessedAttachment.Text; a failure fails the attachment
+	OCR func(r io.Reader) (string, error)
+	// Scan, when set, is given the decoded content of each attachment before
+	// it is written, e.g. to check it with a virus scanner. An attachment it
+	// returns an error for is quarantined: it isn't written, and its message
+	// isn't marked as read unless MarkQuarantinedRead is set
+	Scan func(name string, r io.Reader) error
+	// MarkQuarantinedRead marks messages as read even when Scan quarantined
+	// some of their attachments
+	MarkQuarantinedRead bool
+	// WriteSidecar writes a <filename>.json file holding each attachment's
+	// metadata, through the same generator, after the attachment itself
+	WriteSidecar bool
+	// CaptureHeaders lists the top-level message headers, matched
+	// case-insensitively, copied onto ProcessedAttachment.Headers. When empty
+	// no headers are captured
+	CaptureHeaders []string
+	// ExpectedHashes maps filenames to their hex encoded sha256. When an
+	// attachment's filename is present, its content is verified and the
+	// message is not marked as read on a mismatch
+	ExpectedHashes map[string]string
+	// AcceptMimeTypes lists the MIME types of the attachments processed.
+	// Wildcards such as image/* and */* are supported. Defaults to
+	// application/pdf
+	AcceptMimeTypes []string
+	// MaxPartDepth bounds how deeply nested message parts are walked,
+	// guarding against pathological messages. Defaults to 20
+	MaxPartDepth int
+	// Order is the order messages are processed in. Defaults to Newest, as
+	// returned by Gmail. Oldest lists every matching message up front, held
+	// in memory, instead of only the first page of results
+	Order MessageOrder
+	// Overwrite determines whether existing files are written again.
+	// Defaults to Always
+	Overwrite OverwritePolicy
+	// OutputPath returns the path of the file an attachment is written to,
+	// for the IfNewer policy to check before writing. Defaults to the
+	// Filename, as written by FileGenerator. Set it to the path of a
+	// PathGenerator, e.g. DirPath with DirGenerator
+	OutputPath func(att *ProcessedAttachment) string
+	// SelectPerMessage picks which matching attachments of each message are
+	// processed. Defaults to All
+	SelectPerMessage PartSelection
+	// DecodeContentEncoding decompresses attachments declaring a gzip
+	// Content-Encoding, a non-standard header a few senders use
+	DecodeContentEncoding bool
+	// StreamThreshold is the reported size above which attachments are
+	// decoded and written as a stream rather than buffered in full. Gmail
+	// has no media or ranged download for attachments, so the encoded body
+	// is still received whole. Defaults to 32MiB; zero disables streaming
+	StreamThreshold int64
+	// SMIMEUnwrap opens signed S/MIME envelopes so the attachments they
+	// hide are processed. Encrypted ones are always reported in
+	// Stats.Unresolved
+	SMIMEUnwrap bool
+	// OnlyDisposition, when set, restricts processing to parts whose
+	// Content-Disposition is of the given type, e.g. attachment to exclude
+	// inline content
+	OnlyDisposition string
+	// FilenameRegex, when set, must also match the decoded filename of an
+	// attachment for it to be processed
+	FilenameRegex *regexp.Regexp
+	// AttachmentRetries is how many times retrieving an attachment is
+	// retried after a failure that may be transient, such as a dropped
+	// connection. Downloads can't be resumed, each retry starts over
+	AttachmentRetries int
+	// MinAttachmentBytes skips attachments whose reported size is below it
+	// without downloading them
+	MinAttachmentBytes int64
+	// MessageFetcher retrieves messages in full before their attachments
+	// are matched, e.g. from a local cache. Defaults to a Gmail Get call
+	// honouring FieldMask.Get
+	MessageFetcher func(ctx context.Context, msgID string) (*gmail.Message, error)
+	// BatchGet retrieves listed messages through Gmail's batch endpoint
+	// rather than one call each. Messages a batch fails to retrieve are
+	// retrieved individually. Ignored when MessageFetcher is set
+	BatchGet bool
+	// SkipMessageRefetch uses the payload of listed messages when present
+	// instead of fetching every message again
+	SkipMessageRefetch bool
+	// LastRunStore, when set, limits listed messages to those received after
+	// the previous run. It records the start of a run that listed every
+	// matching message and left none unprocessed; otherwise the date of the
+	// oldest message left, or, when that isn't known, the previous time is
+	// kept. Messages beyond the first page, listed only when Order is Oldest,
+	// keep it from advancing
+	LastRunStore LastRunStore
+	// FieldMask limits the fields Gmail returns for messages. Defaults to
+	// DefaultFieldMask
+	FieldMask FieldMask
+	// WantedHeaders lists the headers MessageHeaders retrieves. Defaults to
+	// DefaultWantedHeaders
+	WantedHeaders []string
+	// InventoryFormat is the format InventoryAttachments, PreviewAttachments
+	// and EstimateDownloadBytes retrieve messages in, trading the size of
+	// responses for finding attachments within multipart messages. Defaults
+	// to MetadataInventory
+	InventoryFormat InventoryFormat
+	// Concurrency is the number of messages retrieved, along with their
+	// attachments, at the same time. Attachments are still written one at a
+	// time in the listed order. Defaults to 1
+	Concurrency int
+	// MailboxConcurrency bounds how many mailboxes ProcessMailboxes
+	// processes at a time. Defaults to 4
+	MailboxConcurrency int
+	// MaxMessagesPerRun ends a run cleanly once that many messages have been
+	// fully processed, leaving the rest for later runs. Messages are only
+	// retrieved, and written, while they could still count towards it. Zero
+	// means no limit
+	MaxMessagesPerRun int
+	// FailFast stops a run at the first error, returning it, instead of
+	// skipping the failed message and carrying on
+	FailFast bool
+	// WriteConcurrency, when set, moves decoding and writing attachments
+	// alongside their retrieval with at most WriteConcurrency writes at a
+	// time, independently of Concurrency. Output order and names are
+	// unchanged, but messages retrieved ahead may be written before FailFast
+	// ends a run. The writer generators, and
+	// hooks such as OCR and Scan, are then called from multiple goroutines at
+	// once and must be safe for concurrent use. When zero attachments are
+	// written one at a time once retrieved
+	WriteConcurrency int
+	// Lockfile, when set, is created exclusively for the duration of a run,
+	// which fails with ErrLocked while another run holds it. A lockfile left
+	// by a crashed run, holding its process ID, must be removed by hand
+	Lockfile string
+	// MarkReadOnlyOnFullSuccess leaves every message unread when any message
+	// or attachment of the run failed, so the next run retries them all
+	MarkReadOnlyOnFullSuccess bool
+	// DryRun prevents any modification of the mailbox, such as marking
+	// messages as read or trashing them
+	DryRun bool
+	// OnMessageProcessed is called with the ID of every message once it has
+	// successfully been marked as read
+	OnMessageProcessed func(msgID string)
+	// OnError, when set, is called with every failure of a run as it happens,
+	// partID being empty when the whole message failed. It is observational;
+	// the run carries on, or not, as it otherwise would. It may be called
+	// from multiple goroutines at once
+	OnError func(msgID, partID string, err error)
+	// RunID identifies the output of a run. A random UUID is generated for
+	// every run when empty
+	RunID string
+	// Metrics receives instrumentation of runs. Defaults to NopMetrics
+	Metrics Metrics
+	// Stats is populated by the last call to ProcessPDFAttachments
+	Stats *Stats
+
+	// opts are the client options the service was created with
+	opts []option.ClientOption
+	// labels caches label names to their IDs
+	labels map[string]string
+	// now returns the current time wherever the service reads it. It
+	// defaults to clockNow and is only meant to be replaced by tests
+	now func() time.Time
 }
 
-// NewService instantiates a new service struct for API calls
-func NewService(config io.Reader, userID string) (*Service, error) {
+// NewService instantiates a new service struct for API calls. opts configure
+// the requests made to Gmail, e.g. option.WithUserAgent to identify the
+// application for quota attribution and support instead of DefaultAppName.
+// They mustn't carry credentials, which come from config
+func NewService(config io.Reader, userID string, opts ...option.ClientOption) (*Service, error) {
 	// Close reader if closable
 	if closer, ok := config.(io.Closer); ok {
 		defer closer.Close()
 	}
 
-	srv := &Service{
-		UserID: userID,
-	}
+	srv := &Service{UserID: userID, opts: opts}
 
 	// initialize the gmail service
 	if err := srv.initializeJWTConfig(config); err != nil {
@@ -43,18 +252,64 @@ func NewService(config io.Reader, userID string) (*Service, error) {
 	}
 
 	// initialize the gmail service
-	ctx := context.Background()
-	gmailSrv, err := gmail.NewService(
-		ctx, option.WithTokenSource(srv.cnf.TokenSource(ctx)))
-	if err != nil {
+	if err := srv.init(srv.jwtSource); err != nil {
 		return nil, err
 	}
+	return srv, nil
+}
+
+// NewTokenService creates a service acting as userID, usually "me", with
+// the tokens of an OAuth2 user flow instead of a service account, see
+// BootstrapOAuth. Features relying on delegation, such as ForUser, aren't
+// available. A request rejected with 401 Unauthorized is retried with the
+// next token of ts, which is only a new one when ts obtains one, e.g. not
+// when it caches tokens until they expire as oauth2.ReuseTokenSource does.
+// See NewService for opts
+func NewTokenService(ts oauth2.TokenSource, userID string, opts ...option.ClientOption) (*Service, error) {
+	return newTokenService(func() oauth2.TokenSource { return ts }, userID, opts)
+}
+
+// newTokenService is NewTokenService for callers able to obtain a new token
+// when Gmail rejects the current one
+func newTokenService(newSource func() oauth2.TokenSource, userID string, opts []option.ClientOption) (*Service, error) {
+	srv := &Service{UserID: userID, opts: opts}
+	if err := srv.init(newSource); err != nil {
+		return nil, err
+	}
+	return srv, nil
+}
+
+// DefaultAppName identifies the package in the user agent of its requests,
+// unless the service is created with option.WithUserAgent
+const DefaultAppName = "gmail-attachments"
+
+// jwtSource returns a new token source for the service account
+func (srv *Service) jwtSource() oauth2.TokenSource {
+	return srv.cnf.TokenSource(context.Background())
+}
+
+// init creates the gmail service authorised by the token sources newSource
+// returns and sets the defaults
+func (srv *Service) init(newSource func() oauth2.TokenSource) error {
+	gmailSrv, client, err := newGmailService(newSource, srv.opts)
+	if err != nil {
+		return err
+	}
+	srv.setDefaults(gmailSrv, client)
+	return nil
+}
+
+// setDefaults sets the gmail service and HTTP client used along with the
+// defaults of the configuration
+func (srv *Service) setDefaults(gmailSrv *gmail.Service, client *http.Client) {
 	srv.srv = gmailSrv
+	srv.client = client
 
 	// Set default file generator
 	srv.WriterGenerator = FileGenerator
-
-	return srv, nil
+	srv.Metrics = NopMetrics{}
+	srv.FieldMask = DefaultFieldMask
+	srv.StreamThreshold = defaultStreamThreshold
 }
 
 func (srv *Service) initializeJWTConfig(r io.Reader) error {
@@ -63,8 +318,7 @@ func (srv *Service) initializeJWTConfig(r io.Reader) error {
 		return err
 	}
 
-	srv.cnf, err = google.JWTConfigFromJSON(
-		data, gmail.GmailReadonlyScope, gmail.GmailModifyScope)
+	srv.cnf, err = google.JWTConfigFromJSON(data, requiredScopes...)
 	if err != nil {
 		return err
 	}
@@ -74,16 +328,57 @@ func (srv *Service) initializeJWTConfig(r io.Reader) error {
 
 // ListMessages fetches messages from the specified userID
 func (srv *Service) ListMessages() ([]*gmail.Message, error) {
+	return srv.ListMessagesContext(context.Background())
+}
+
+// ListMessagesContext is like ListMessages but uses ctx for the calls made,
+// so cancelling it stops listing, e.g. half way through the pages needed when
+// Order is Oldest
+func (srv *Service) ListMessagesContext(ctx context.Context) ([]*gmail.Message, error) {
+	msgs, _, err := srv.listMessages(ctx)
+	return msgs, err
+}
+
+// listMessages is like ListMessagesContext but also reports whether every
+// page of matching messages was listed
+func (srv *Service) listMessages(ctx context.Context) ([]*gmail.Message, bool, error) {
+	q, err := srv.query()
+	if err != nil {
+		return nil, false, err
+	}
 	call := srv.srv.Users.Messages.List(srv.UserID)
-	if srv.DefaultQ != "" {
-		call = call.Q(srv.DefaultQ)
+	if q != "" {
+		call = call.Q(q)
+	}
+	if ids := srv.labelIDs(); len(ids) > 0 {
+		call = call.LabelIds(ids...)
+	}
+	if srv.FieldMask.List != "" {
+		call = call.Fields(srv.FieldMask.List)
+	}
+
+	if srv.Order == Oldest {
+		// the oldest messages are on the last page, so every page is needed
+		var msgs []*gmail.Message
+		err := call.Pages(ctx, func(rep *gmail.ListMessagesResponse) error {
+			msgs = append(msgs, rep.Messages...)
+			return nil
+		})
+		if err != nil {
+			return nil, false, quotaError(err)
+		}
+		for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+			msgs[i], msgs[j] = msgs[j], msgs[i]
+		}
+		return msgs, true, nil
 	}
-	rep, err := call.Do()
+
+	rep, err := call.Context(ctx).Do()
 	if err != nil {
-		return nil, err
+		return nil, false, quotaError(err)
 	}
 
-	return rep.Messages, nil
+	return rep.Messages, rep.NextPageToken == "", nil
 }
 
 // WriterGenerator defines a function that defines where the attachment contents
@@ -93,25 +388,164 @@ func (srv *Service) ListMessages() ([]*gmail.Message, error) {
 // the writer interface
 type WriterGenerator func(filename string) (io.Writer, error)
 
+// AttachmentWriterGenerator is like WriterGenerator but is handed the
+// attachment metadata, such as the message date, alongside the filename.
+// Body is nil at the time it is invoked
+type AttachmentWriterGenerator func(att *ProcessedAttachment) (io.Writer, error)
+
+// WriterErrorPolicy defines how a run proceeds when WriterGenerator returns
+// an error
+type WriterErrorPolicy int
+
+const (
+	// Skip records the error and continues with the next part. The message
+	// is not marked as read
+	Skip WriterErrorPolicy = iota
+	// Fail aborts the run and returns the error
+	Fail
+	// Retry re-invokes WriterGenerator up to WriterRetries times, with a
+	// growing wait in between, before falling back to Skip
+	Retry
+)
+
+// defaultStreamThreshold is the default Service.StreamThreshold
+const defaultStreamThreshold = 32 << 20
+
+// defaultMaxPartDepth is used when Service.MaxPartDepth isn't set
+const defaultMaxPartDepth = 20
+
+// OverwritePolicy determines whether attachments are written over existing
+// files
+type OverwritePolicy int
+
+const (
+	// Always writes every attachment
+	Always OverwritePolicy = iota
+	// IfNewer skips attachments whose file exists with a modification time at
+	// or after the message date, making repeated runs an incremental sync.
+	// The file is found at Service.OutputPath, which must match where the
+	// generator writes; combine with ModTimeGenerator so written files carry
+	// the message date
+	IfNewer
+)
+
+// MessageOrder determines the order listed messages are processed in
+type MessageOrder int
+
+const (
+	// Newest processes the most recently received messages first
+	Newest MessageOrder = iota
+	// Oldest processes messages in the order they were received
+	Oldest
+)
+
+// PartSelection determines which of the matching attachments of a message
+// are processed
+type PartSelection int
+
+const (
+	// All processes every matching attachment
+	All PartSelection = iota
+	// First processes only the first matching attachment
+	First
+	// Largest processes only the largest matching attachment, as reported by
+	// Gmail before it is downloaded
+	Largest
+)
+
+// WriterError is returned when WriterGenerator fails to provide a writer
+type WriterError struct {
+	Filename string
+	Err      error
+}
+
+func (e *WriterError) Error() string {
+	return fmt.Sprintf("writer for %s: %s", e.Filename, e.Err)
+}
+
+// Unwrap returns the error returned by WriterGenerator
+func (e *WriterError) Unwrap() error {
+	return e.Err
+}
+
 // ProcessedAttachment file contents read from the emails fetched
 type ProcessedAttachment struct {
+	// Body reads back the written contents. It is nil when the writer
+	// provided by the generator can't be read from
 	Body     io.Reader
 	Filename string
+	// Path is where the attachment was written, set by generators writing
+	// files. When a generator doesn't set it, the name of a writer that is
+	// a file, such as one returned by FileGenerator, is used
+	Path string
 	// Original filename
 	OriginalName string
-	Headers      []*gmail.MessagePartHeader
+	// MessageID of the message the attachment was read from
+	MessageID string
+	// ThreadID of the conversation the message belongs to
+	ThreadID string
+	// PartID of the message part holding the attachment
+	PartID   string
+	MimeType string
+	// MatchedBy lists the filters the attachment matched, e.g.
+	// mime:application/pdf,regex:^statement
+	MatchedBy string
+	// Size of the decoded attachment in bytes
+	Size int64
+	// SHA256 is the hex encoded sha256 of the decoded attachment
+	SHA256 string
+	// From is the address of the sender, or the raw From header when it
+	// can't be parsed
+	From string
+	// FromName is the display name of the sender
+	FromName string
+	// RunID of the run that processed the attachment
+	RunID string
+	// Headers of the message listed in Service.CaptureHeaders
+	Headers []*gmail.MessagePartHeader
+	// Subject of the message the attachment was read from
+	Subject string
+	// DeliveredTo is the address, such as an alias, the message was
+	// delivered to
+	DeliveredTo string
+	// Date of the message as set in its Date header. Zero if the header is
+	// missing or can't be parsed
+	Date time.Time
+	// InternalDate is when Gmail received the message, which is more
+	// reliable than Date for ordering
+	InternalDate time.Time
+	// FetchDuration is the time taken to retrieve the attachment from Gmail
+	FetchDuration time.Duration
+	// DecodeDuration is the time taken to decode the attachment body
+	DecodeDuration time.Duration
+	// Text is the text extracted from a PDF by Service.OCR
+	Text string
+	// WriteErr holds the error returned when closing a write only writer or
+	// writing the sidecar. The message is not marked as read when set
+	WriteErr error
+	// Quarantined holds the error Service.Scan rejected the attachment with,
+	// in which case it wasn't written
+	Quarantined error
 }
 
 // ProcessedAttachments a slice of ProcessAttachment
 type ProcessedAttachments []*ProcessedAttachment
 
-// Close closes readers which also implement Closer interface
+// Close closes readers which also implement Closer interface. Every reader is
+// closed even if closing another fails, the first error is returned
 func (at ProcessedAttachments) Close() error {
+	return at.CloseContext(context.Background())
+}
+
+// CloseContext is like Close, but once ctx is done readers implementing
+// Aborter are aborted rather than closed so partial output, such as an
+// in-flight upload, is discarded instead of finalised
+func (at ProcessedAttachments) CloseContext(ctx context.Context) error {
 	var err error
 
 	for _, a := range at {
 		if closer, ok := a.Body.(io.Closer); ok {
-			if er := closer.Close(); er != nil && err == nil {
+			if er := closeContext(ctx, closer); er != nil && err == nil {
 				err = er
 			}
 		}
@@ -120,8 +554,43 @@ func (at ProcessedAttachments) Close() error {
 	return err
 }
 
-// FileGenerator returns a system file
+// Aborter is implemented by writers whose output can be discarded instead of
+// being finalised by Close. Decorating generators may hide it
+type Aborter interface {
+	Abort(err error) error
+}
+
+// closeContext closes c, or aborts it with ctx's error once ctx is done
+func closeContext(ctx context.Context, c io.Closer) error {
+	if ctx.Err() != nil {
+		if aborter, ok := c.(Aborter); ok {
+			if err := aborter.Abort(ctx.Err()); err != nil {
+				return err
+			}
+			return ctx.Err()
+		}
+	}
+	return c.Close()
+}
+
+// discardWriter releases w once writing to it failed with err, aborting it
+// when possible so partial output isn't finalised
+func discardWriter(w io.Writer, err error) {
+	if aborter, ok := w.(Aborter); ok {
+		aborter.Abort(err)
+	} else if closer, ok := w.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// FileGenerator returns a system file, creating any missing parent
+// directories
 func FileGenerator(filename string) (io.Writer, error) {
+	if dir := filepath.Dir(filename); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
 	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return nil, err
@@ -131,93 +600,700 @@ func FileGenerator(filename string) (io.Writer, error) {
 
 // ProcessPDFAttachments reads pdf attachments from the emails fetched
 func (srv *Service) ProcessPDFAttachments(markRead bool) (ProcessedAttachments, error) {
-	msgs, err := srv.ListMessages()
+	return srv.ProcessPDFAttachmentsContext(context.Background(), markRead)
+}
+
+// ProcessPDFAttachmentsContext is like ProcessPDFAttachments but uses ctx for
+// the calls made, from listing messages to marking them as read
+func (srv *Service) ProcessPDFAttachmentsContext(ctx context.Context, markRead bool) (ProcessedAttachments, error) {
+	if srv.Lockfile != "" {
+		release, err := acquireLock(srv.Lockfile)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
+	start := srv.timeNow()
+	msgs, listedAll, err := srv.listMessages(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	processedAttachments, progress, err := srv.processMessages(ctx, msgs, markRead)
+	if err != nil {
+		return processedAttachments, err
+	}
+
+	if srv.LastRunStore != nil {
+		if next, ok := progress.resumeAt(start, listedAll); ok {
+			if err := srv.LastRunStore.Set(next); err != nil {
+				return processedAttachments, err
+			}
+		}
+	}
+
+	return processedAttachments, nil
+}
+
+// ProcessMessageIDs is like ProcessPDFAttachmentsContext but processes the
+// messages with the given IDs instead of listing them, e.g. when another
+// system has already selected them. Each ID is handled on its own: IDs of
+// messages that don't exist are recorded in Stats.Vanished, empty ones in
+// Stats.InvalidMessages, and neither keeps the others from being processed
+// and, when markRead is set, marked as read. LastRunStore isn't updated
+func (srv *Service) ProcessMessageIDs(ctx context.Context, ids []string, markRead bool) (*Result, error) {
+	if srv.Lockfile != "" {
+		release, err := acquireLock(srv.Lockfile)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
+	msgs := make([]*gmail.Message, len(ids))
+	for i, id := range ids {
+		msgs[i] = &gmail.Message{Id: id}
+	}
+	res := &Result{}
+	res.Attachments, _, res.Err = srv.processMessages(ctx, msgs, markRead)
+	res.Stats = srv.Stats
+	return res, res.Err
+}
+
+// runProgress records the messages a run left for the next one
+type runProgress struct {
+	// truncated is set when MaxMessagesPerRun left messages unprocessed
+	truncated bool
+	// oldest is the earliest date of the messages left unprocessed by a
+	// failure or a quarantined attachment
+	oldest time.Time
+	// undated is set when such a message has no known date
+	undated bool
+}
+
+// leave records msg as left unprocessed
+func (p *runProgress) leave(msg *gmail.Message) {
+	date := internalDate(msg)
+	switch {
+	case date.IsZero():
+		p.undated = true
+	case p.oldest.IsZero() || date.Before(p.oldest):
+		p.oldest = date
+	}
+}
+
+// resumeAt returns the time LastRunStore should hold after a run started at
+// start, so the next run lists every message this one left unprocessed: start
+// when every page was listed and nothing was left, otherwise the date of the
+// oldest message left. ok is false when that date isn't known, as for
+// messages beyond the pages listed, and the stored time must be kept
+func (p *runProgress) resumeAt(start time.Time, listedAll bool) (next time.Time, ok bool) {
+	if !listedAll || p.truncated || p.undated {
+		return time.Time{}, false
+	}
+	if !p.oldest.IsZero() && p.oldest.Before(start) {
+		return p.oldest, true
+	}
+	return start, true
+}
+
+// processMessages processes the attachments of msgs, marking them as read
+// when markRead is set, and reports which messages it left for the next run
+func (srv *Service) processMessages(ctx context.Context, msgs []*gmail.Message, markRead bool) (ProcessedAttachments, *runProgress, error) {
+	if err := srv.resetStats(); err != nil {
+		return nil, nil, err
+	}
+	msgs = srv.validMessages(msgs)
+	if srv.BatchGet && srv.MessageFetcher == nil {
+		if err := srv.prefetchMessages(ctx, msgs); err != nil {
+			return nil, nil, err
+		}
+	}
 	processedAttachments := make([]*ProcessedAttachment, 0)
 	processedMsgs := make([]*gmail.Message, 0)
+	progress := &runProgress{}
+	// failed is set once any message or attachment fails
+	failed := false
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	// retrieve the payload part of the message
 OUTER:
-	for i, msg := range msgs {
-		if m, err := retrieveMessage(srv.srv, srv.UserID, msg.Id); err == nil {
-			msgs[i] = m
-			msg = m
+	for res := range srv.fetchMessages(fetchCtx, msgs) {
+		select {
+		case <-ctx.Done():
+			return processedAttachments, nil, ctx.Err()
+		default:
 		}
-		// Retrieve the parts with attachments
-		parts, err := srv.retrieveMessageAttachments(msg, msg.Payload)
-		if err != nil {
+		msg := res.msg
+		if res.err != nil {
+			if errors.Is(res.err, ErrQuotaExceeded) {
+				// further calls would be rejected as well
+				srv.metrics().IncErrors(ErrorKindRetrieve)
+				return processedAttachments, nil, res.err
+			}
+			res.release()
+			if isNotFound(res.err) {
+				// deleted since it was listed
+				srv.Stats.Vanished = append(srv.Stats.Vanished, msg.Id)
+				continue
+			}
+			srv.metrics().IncErrors(ErrorKindRetrieve)
+			failed = true
+			progress.leave(msg)
+			if srv.FailFast {
+				return processedAttachments, nil, res.err
+			}
+			continue
+		}
+		if res.skipped {
+			res.release()
+			srv.Stats.SkippedLabels++
 			continue
 		}
 		// Read the attachments to the provided writer from WriterGenerator
-		for _, p := range parts {
-			att, err := srv.processAttachment(msg, p)
+		results := res.results
+		if results == nil {
+			results = srv.processParts(ctx, msg, res.parts, nil, nil)
+		}
+		complete := true
+		for _, r := range results {
+			att, err, p := r.att, r.err, r.part
+			if err == nil && att == nil {
+				// skipped, e.g. by the Overwrite policy
+				continue
+			}
+			if err == nil && att.Quarantined != nil {
+				processedAttachments = append(processedAttachments, att)
+				if !srv.MarkQuarantinedRead {
+					complete = false
+				}
+				continue
+			}
 			if err == nil {
 				processedAttachments = append(processedAttachments, att)
+				srv.Stats.Attachments++
+				srv.Stats.Fetch.observe(att.FetchDuration)
+				srv.Stats.Decode.observe(att.DecodeDuration)
+				srv.metrics().IncAttachments(1)
+				srv.metrics().IncBytes(att.Size)
+				srv.metrics().ObserveFetchDuration(att.FetchDuration)
+				if att.WriteErr != nil {
+					srv.metrics().IncErrors(ErrorKindWrite)
+					attErr := srv.Stats.recordError(msg, p.MessagePart, att.WriteErr)
+					srv.reportError(msg.Id, p.PartId, att.WriteErr)
+					failed = true
+					if srv.FailFast {
+						return processedAttachments, nil, attErr
+					}
+					complete = false
+				}
+				continue
+			}
+			attErr := srv.Stats.recordError(msg, p.MessagePart, err)
+			srv.reportError(msg.Id, p.PartId, err)
+			failed = true
+			if _, ok := err.(*WriterError); ok {
+				srv.metrics().IncErrors(ErrorKindWrite)
 			} else {
+				srv.metrics().IncErrors(ErrorKindProcess)
+			}
+			if srv.FailFast {
+				return processedAttachments, nil, attErr
+			}
+			if _, ok := err.(*WriterError); !ok {
+				res.release()
+				progress.leave(msg)
 				// continue to the outer loop
 				continue OUTER
 			}
+			if srv.OnWriterError == Fail {
+				return processedAttachments, nil, attErr
+			}
+			complete = false
+		}
+		if !complete {
+			res.release()
+			progress.leave(msg)
+			continue
 		}
 		// add message to the list of processed messages
 		processedMsgs = append(processedMsgs, msg)
+		srv.Stats.Messages++
+		srv.metrics().IncMessages(1)
+		if srv.MaxMessagesPerRun > 0 && len(processedMsgs) >= srv.MaxMessagesPerRun {
+			// leave the remaining messages for the next run
+			progress.truncated = true
+			break
+		}
+	}
+
+	// retrieval stops early once cancelled
+	if err := ctx.Err(); err != nil {
+		return processedAttachments, nil, err
 	}
 
 	// make the msgs are read if markRead is true
-	if markRead {
-		markAsRead(srv.srv, srv.UserID, processedMsgs)
+	if markRead && !srv.DryRun && !(srv.MarkReadOnlyOnFullSuccess && failed) {
+		err := markAsRead(ctx, srv.srv, srv.UserID, processedMsgs)
+		srv.notifyProcessed(processedMsgs, err)
+		if err != nil {
+			srv.metrics().IncErrors(ErrorKindMarkRead)
+			return processedAttachments, nil, err
+		}
 	}
 
-	return processedAttachments, nil
+	return processedAttachments, progress, nil
 }
 
-func (srv *Service) processAttachment(msg *gmail.Message, part *gmail.MessagePart) (*ProcessedAttachment, error) {
-	filename := constructFilename(part, msg)
-	f, err := srv.WriterGenerator(filename)
+// notifyProcessed calls OnMessageProcessed for the msgs marked as read, those
+// of msgs not left unmodified according to the error marking them failed with
+func (srv *Service) notifyProcessed(msgs []*gmail.Message, err error) {
+	if srv.OnMessageProcessed == nil {
+		return
+	}
+	unmodified := make(map[string]bool)
 	if err != nil {
-		return nil, err
+		var modErr *ModifyError
+		if !errors.As(err, &modErr) {
+			return
+		}
+		for _, id := range modErr.MessageIDs {
+			unmodified[id] = true
+		}
 	}
+	for _, msg := range msgs {
+		if !unmodified[msg.Id] {
+			srv.OnMessageProcessed(msg.Id)
+		}
+	}
+}
 
-	fileContent, err := base64.URLEncoding.DecodeString(part.Body.Data)
+// contentReader returns a reader of the decoded content of part, which is
+// decoded again when streamed rather than held in content
+func (srv *Service) contentReader(part *attachmentPart, content []byte, stream bool) (io.Reader, error) {
+	if stream {
+		return srv.partReader(part.MessagePart)
+	}
+	return bytes.NewReader(content), nil
+}
+
+func (srv *Service) processAttachment(ctx context.Context, msg *gmail.Message, part *attachmentPart) (*ProcessedAttachment, error) {
+	p, err := srv.prepareAttachment(msg, part)
 	if err != nil {
 		return nil, err
 	}
-	if _, err := f.Write(fileContent); err != nil {
+	srv.claimFilename(p.att)
+	return srv.writeAttachment(ctx, p)
+}
+
+// preparedAttachment is an attachment decoded and named, but not written
+type preparedAttachment struct {
+	part *attachmentPart
+	att  *ProcessedAttachment
+	// content holds the decoded contents unless they are streamed
+	content []byte
+	stream  bool
+}
+
+// prepareAttachment decodes part and describes it, naming it before the
+// name is made unique by claimFilename
+func (srv *Service) prepareAttachment(msg *gmail.Message, part *attachmentPart) (*preparedAttachment, error) {
+	start := srv.timeNow()
+	stream := srv.StreamThreshold > 0 && part.Body.Size > srv.StreamThreshold
+	var fileContent []byte
+	var size int64
+	hash := sha256.New()
+	if stream {
+		// hash in a first pass; the body is decoded again while writing
+		r, err := srv.partReader(part.MessagePart)
+		if err != nil {
+			return nil, err
+		}
+		if size, err = io.Copy(hash, r); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if fileContent, err = srv.decodePart(part.MessagePart); err != nil {
+			return nil, err
+		}
+		hash.Write(fileContent)
+		size = int64(len(fileContent))
+	}
+	decodeDuration := srv.timeNow().Sub(start)
+
+	att := &ProcessedAttachment{
+		OriginalName: originalFilename(part.MessagePart),
+		MessageID:    msg.Id,
+		ThreadID:     msg.ThreadId,
+		PartID:       part.PartId,
+		MimeType:     part.MimeType,
+		MatchedBy:    srv.matchedBy(part.MessagePart),
+		Size:         size,
+		SHA256:       hex.EncodeToString(hash.Sum(nil)),
+		RunID:        srv.Stats.RunID,
+		Headers:      captureHeaders(msg, srv.CaptureHeaders),
+		Subject:      messageHeader(msg, "Subject"),
+		DeliveredTo:  deliveredTo(msg),
+		Date:         messageDate(msg),
+		InternalDate: internalDate(msg),
+
+		FetchDuration:  part.fetchDuration,
+		DecodeDuration: decodeDuration,
+	}
+	if msg.Payload != nil {
+		att.From, att.FromName = parseFrom(headerValue(msg.Payload.Headers, "From"))
+	}
+	var err error
+	if att.Filename, err = srv.attachmentFilename(msg, part.MessagePart, att); err != nil {
 		return nil, err
 	}
+	return &preparedAttachment{part: part, att: att, content: fileContent, stream: stream}, nil
+}
 
-	return &ProcessedAttachment{
-		Filename:     filename,
-		OriginalName: part.Filename,
-		Body:         f.(io.Reader),
-		Headers:      part.Headers,
-	}, nil
+// claimFilename makes the name of att unique within the run according to
+// Dedup. Names are claimed in the order attachments are processed
+func (srv *Service) claimFilename(att *ProcessedAttachment) {
+	if !srv.ContentAddressed {
+		att.Filename = srv.dedupFilename(att.Filename, att)
+	}
 }
 
-func (srv *Service) retrieveMessageAttachments(msg *gmail.Message, part *gmail.MessagePart) ([]*gmail.MessagePart, error) {
-	if part.MimeType == "application/pdf" {
-		// Retrieve the attachment
-		body, err := retrieveAttachment(srv.srv, srv.UserID, msg, part.Body)
+// writeAttachment verifies, scans and writes a prepared attachment
+func (srv *Service) writeAttachment(ctx context.Context, p *preparedAttachment) (*ProcessedAttachment, error) {
+	att, part, fileContent, stream := p.att, p.part, p.content, p.stream
+	if err := srv.verifyHash(att.Filename, att.SHA256); err != nil {
+		return nil, err
+	}
+	if srv.Scan != nil {
+		r, err := srv.contentReader(part, fileContent, stream)
 		if err != nil {
-			return []*gmail.MessagePart{}, err
+			return nil, err
+		}
+		if att.Quarantined = srv.Scan(att.Filename, r); att.Quarantined != nil {
+			srv.Stats.incr(&srv.Stats.Quarantined)
+			return att, nil
+		}
+	}
+	if srv.OCR != nil && mimeMatches(defaultMimeType, att.MimeType) {
+		r, err := srv.contentReader(part, fileContent, stream)
+		if err != nil {
+			return nil, err
+		}
+		if att.Text, err = srv.OCR(r); err != nil {
+			return nil, fmt.Errorf("ocr %s: %w", att.Filename, err)
 		}
-		part.Body = body
-		return []*gmail.MessagePart{part}, nil
+	}
+	if srv.Overwrite == IfNewer && !isNewer(srv.outputPath(att), att.partitionDate()) {
+		srv.Stats.incr(&srv.Stats.SkippedNotNewer)
+		return nil, nil
 	}
 
-	parts := make([]*gmail.MessagePart, 0)
-	for _, part := range part.Parts {
-		prts, err := srv.retrieveMessageAttachments(msg, part)
+	f, err := srv.newWriter(ctx, att)
+	if err != nil {
+		return nil, err
+	}
+	if named, ok := f.(namedCloser); ok && att.Path == "" {
+		att.Path = named.Name()
+	}
+	if stream {
+		var r io.Reader
+		if r, err = srv.partReader(part.MessagePart); err == nil {
+			_, err = io.Copy(f, r)
+		}
+	} else {
+		_, err = f.Write(fileContent)
+	}
+	if err != nil {
+		discardWriter(f, err)
+		return nil, err
+	}
+	if r, ok := f.(io.Reader); ok {
+		att.Body = r
+	} else if closer, ok := f.(io.Closer); ok {
+		// write only sinks, such as uploads, are finalised straight away
+		att.WriteErr = closeContext(ctx, closer)
+	}
+	if srv.WriteSidecar && att.WriteErr == nil {
+		att.WriteErr = srv.writeSidecar(ctx, att)
+	}
+
+	return att, nil
+}
+
+// outputPath returns the path att is written to according to OutputPath
+func (srv *Service) outputPath(att *ProcessedAttachment) string {
+	if srv.OutputPath == nil {
+		return att.Filename
+	}
+	return srv.OutputPath(att)
+}
+
+// isNewer reports whether date is after the modification time of the file at
+// path. Missing files, and unknown dates, are always newer
+func isNewer(path string, date time.Time) bool {
+	info, err := os.Stat(path)
+	if err != nil || date.IsZero() {
+		return true
+	}
+	return date.After(info.ModTime())
+}
+
+// writerBackoff is the wait before re-invoking a failed generator, doubling
+// with each further attempt
+var writerBackoff = time.Second
+
+// newWriter invokes the configured generator, retrying according to
+// OnWriterError. Cancelling ctx ends the wait between attempts
+func (srv *Service) newWriter(ctx context.Context, att *ProcessedAttachment) (io.Writer, error) {
+	attempts := 1
+	if srv.OnWriterError == Retry {
+		attempts += srv.WriterRetries
+	}
+
+	var err error
+	backoff := writerBackoff
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			if err := sleep(ctx, backoff); err != nil {
+				return nil, &WriterError{Filename: att.Filename, Err: err}
+			}
+			backoff *= 2
+		}
+
+		var w io.Writer
+		if srv.AttachmentWriterGenerator != nil {
+			w, err = srv.AttachmentWriterGenerator(att)
+		} else {
+			w, err = srv.WriterGenerator(att.Filename)
+		}
 		if err == nil {
-			parts = append(parts, prts...)
+			return w, nil
 		}
 	}
+	return nil, &WriterError{Filename: att.Filename, Err: err}
+}
 
-	// Return an empty list
+// attachmentPart is a message part whose body has been retrieved
+type attachmentPart struct {
+	*gmail.MessagePart
+	fetchDuration time.Duration
+}
+
+// retrieveMessageAttachments finds the attachments in part to be processed
+// and retrieves their bodies. bodies caches the retrieved bodies by attachment
+// ID so parts referencing the same attachment only retrieve it once
+func (srv *Service) retrieveMessageAttachments(ctx context.Context, msg *gmail.Message, part *gmail.MessagePart, bodies map[string]*gmail.MessagePartBody) ([]*attachmentPart, error) {
+	if err := srv.unwrapSMIME(msg, part); err != nil {
+		srv.reportError(msg.Id, "", err)
+		return nil, err
+	}
+	disambiguatePartIDs(part, srv.maxPartDepth())
+	m := &partMatch{}
+	srv.matchParts(msg, part, m)
+	if m.unmatched > 0 {
+		srv.Stats.recordUnmatched(msg, m.unmatched, len(m.parts) == 0)
+	}
+	if m.tooDeep {
+		srv.Stats.recordTooDeep(msg)
+	}
+	matched := srv.selectParts(m.parts)
+
+	parts := make([]*attachmentPart, 0, len(matched))
+	for _, part := range matched {
+		p, err := srv.retrievePart(ctx, msg, part, bodies)
+		if err != nil {
+			srv.reportError(msg.Id, part.PartId, err)
+			return nil, err
+		}
+		parts = append(parts, p)
+	}
 	return parts, nil
 }
 
+// reportError passes a failure to OnError, when set
+func (srv *Service) reportError(msgID, partID string, err error) {
+	if srv.OnError != nil {
+		srv.OnError(msgID, partID, err)
+	}
+}
+
+// partMatch accumulates the outcome of walking the parts of a message
+type partMatch struct {
+	// parts are the attachments to be processed
+	parts []*gmail.MessagePart
+	// unmatched counts attachments whose MIME type or filename wasn't
+	// accepted
+	unmatched int
+	// tooDeep is set when parts nested beyond MaxPartDepth were ignored
+	tooDeep bool
+}
+
+// matchParts walks part collecting the attachments to be processed into m
+func (srv *Service) matchParts(msg *gmail.Message, part *gmail.MessagePart, m *partMatch) {
+	walkParts(part, 0, func(part *gmail.MessagePart, depth int) error {
+		if depth > srv.maxPartDepth() {
+			m.tooDeep = true
+			return SkipParts
+		}
+		// content held elsewhere would otherwise be written empty
+		if location := headerValue(part.Headers, "Content-Location"); location != "" && len(part.Parts) == 0 && !hasBody(part) {
+			srv.Stats.recordUnresolved(msg, part, location)
+			return SkipParts
+		}
+
+		switch ok, reason := srv.shouldProcess(part, msg); {
+		case ok:
+			m.parts = append(m.parts, part)
+			return SkipParts
+		case reason == skipFilename:
+			m.unmatched++
+			return SkipParts
+		case reason == skipSize:
+			srv.Stats.incr(&srv.Stats.SkippedTooSmall)
+			return SkipParts
+		case reason != skipMimeType:
+			return SkipParts
+		}
+
+		if len(part.Parts) == 0 && isAttachment(part) {
+			m.unmatched++
+		}
+		return nil
+	})
+}
+
+// maxPartDepth returns MaxPartDepth, or its default when unset
+func (srv *Service) maxPartDepth() int {
+	if srv.MaxPartDepth <= 0 {
+		return defaultMaxPartDepth
+	}
+	return srv.MaxPartDepth
+}
+
+// selectParts picks the parts to retrieve according to SelectPerMessage
+func (srv *Service) selectParts(parts []*gmail.MessagePart) []*gmail.MessagePart {
+	if len(parts) < 2 {
+		return parts
+	}
+
+	switch srv.SelectPerMessage {
+	case First:
+		return parts[:1]
+	case Largest:
+		largest := parts[0]
+		for _, part := range parts[1:] {
+			if bodySize(part) > bodySize(largest) {
+				largest = part
+			}
+		}
+		return []*gmail.MessagePart{largest}
+	}
+	return parts
+}
+
+// retrievePart retrieves the body of the attachment held by part
+func (srv *Service) retrievePart(ctx context.Context, msg *gmail.Message, part *gmail.MessagePart, bodies map[string]*gmail.MessagePartBody) (*attachmentPart, error) {
+	if body, ok := bodies[part.Body.AttachmentId]; ok {
+		srv.Stats.incr(&srv.Stats.AttachmentCacheHits)
+		part.Body = body
+		return &attachmentPart{part, 0}, nil
+	}
+
+	start := srv.timeNow()
+	body, err := srv.retrieveBody(ctx, msg, part)
+	if err != nil {
+		return nil, &AttachmentError{
+			MessageID: msg.Id,
+			PartID:    part.PartId,
+			Filename:  part.Filename,
+			Err:       err,
+		}
+	}
+	if part.Body.AttachmentId != "" {
+		bodies[part.Body.AttachmentId] = body
+	}
+	part.Body = body
+	return &attachmentPart{part, srv.timeNow().Sub(start)}, nil
+}
+
+// MarkUnread marks the given messages as unread again, so that a following
+// run picks them up. It suits compensating for a failed downstream step and
+// is a no-op when DryRun is set
+func (srv *Service) MarkUnread(ctx context.Context, msgIds []string) error {
+	if srv.DryRun {
+		return nil
+	}
+	return modifyLabels(ctx, srv.srv, srv.UserID, msgIds, []string{"UNREAD"}, nil)
+}
+
+// attachmentBackoff is the wait before retrying an attachment retrieval,
+// doubling with each further attempt
+var attachmentBackoff = time.Second
+
+// retrieveBody retrieves the body of part, retrying up to AttachmentRetries
+// times on failures that may be transient. Gmail has no ranged download of
+// attachments, so every attempt starts over. Cancelling ctx ends the wait
+// between attempts
+func (srv *Service) retrieveBody(ctx context.Context, msg *gmail.Message, part *gmail.MessagePart) (*gmail.MessagePartBody, error) {
+	backoff := attachmentBackoff
+	for attempt := 0; ; attempt++ {
+		body, err := retrieveAttachment(srv.srv, srv.UserID, msg, part.Body)
+		if err == nil && body.Data == "" && part.Body.Size > 0 {
+			// Gmail reported contents it didn't return
+			err = ErrEmptyAttachment
+		}
+		if err == nil || attempt >= srv.AttachmentRetries || !isRetryable(err) {
+			return body, err
+		}
+		if err := sleep(ctx, backoff); err != nil {
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// TrashMessage moves a single message to the trash. It requires the modify
+// scope and is a no-op when DryRun is set
+func (srv *Service) TrashMessage(ctx context.Context, msgID string) error {
+	if srv.DryRun {
+		return nil
+	}
+
+	call := srv.srv.Users.Messages.Trash(srv.UserID, msgID).Context(ctx)
+	_, err := call.Do()
+	return quotaError(err)
+}
+
+// timeNow returns the current time according to srv.now, or clockNow when
+// it isn't set
+func (srv *Service) timeNow() time.Time {
+	if srv.now == nil {
+		return clockNow()
+	}
+	return srv.now()
+}
+
+// clockNow and clockAfter are the clock of code without a Service at hand,
+// and of the waits between retries. They are only meant to be replaced by
+// tests
+var (
+	clockNow   = time.Now
+	clockAfter = time.After
+)
+
+// sleep waits for d according to clockAfter, returning ctx's error if it is
+// done first
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-clockAfter(d):
+		return nil
+	}
+}
+
 // GmailService returns the underlying gmail service
 func (srv *Service) GmailService() *gmail.Service {
 	return srv.srv
@@ -0,0 +1,1302 @@
+package gmail
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+func TestRunProgressResumeAt(t *testing.T) {
+	start := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	older := start.Add(-72 * time.Hour)
+	oldest := start.Add(-96 * time.Hour)
+	dated := func(t time.Time) *gmail.Message {
+		return &gmail.Message{InternalDate: t.UnixNano() / int64(time.Millisecond)}
+	}
+
+	tests := []struct {
+		name      string
+		listedAll bool
+		truncated bool
+		left      []*gmail.Message
+		want      time.Time
+		wantOK    bool
+	}{
+		{name: "complete", listedAll: true, want: start, wantOK: true},
+		{name: "more pages", listedAll: false},
+		{name: "truncated", listedAll: true, truncated: true},
+		{name: "failed messages", listedAll: true, left: []*gmail.Message{dated(older), dated(oldest)}, want: oldest, wantOK: true},
+		{name: "undated failure", listedAll: true, left: []*gmail.Message{dated(older), {}}},
+		{name: "more pages and failure", left: []*gmail.Message{dated(older)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &runProgress{truncated: tt.truncated}
+			for _, msg := range tt.left {
+				p.leave(msg)
+			}
+			got, ok := p.resumeAt(start, tt.listedAll)
+			if ok != tt.wantOK || !got.Equal(tt.want) {
+				t.Errorf("resumeAt() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// pdfMessage returns a message received at date carrying a PDF attachment,
+// with inline data, named after each of filenames
+func pdfMessage(id string, date time.Time, filenames ...string) *gmail.Message {
+	payload := &gmail.MessagePart{
+		MimeType: "multipart/mixed",
+		Headers: []*gmail.MessagePartHeader{
+			{Name: "From", Value: "Reports <reports@example.com>"},
+			{Name: "Subject", Value: "report " + id},
+		},
+	}
+	for i, name := range filenames {
+		data := []byte("%PDF-1.4 " + id + "/" + name)
+		payload.Parts = append(payload.Parts, &gmail.MessagePart{
+			PartId:   strconv.Itoa(i),
+			MimeType: "application/pdf",
+			Filename: name,
+			Body: &gmail.MessagePartBody{
+				Data: base64.URLEncoding.EncodeToString(data),
+				Size: int64(len(data)),
+			},
+		})
+	}
+	return &gmail.Message{
+		Id:           id,
+		ThreadId:     "thread-" + id,
+		InternalDate: date.UnixNano() / int64(time.Millisecond),
+		Payload:      payload,
+	}
+}
+
+// memFiles collects the attachments written through its generator in memory
+type memFiles struct {
+	mu    sync.Mutex
+	files map[string]*bytes.Buffer
+	order []string
+}
+
+func (m *memFiles) generator(filename string) (io.Writer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.files == nil {
+		m.files = make(map[string]*bytes.Buffer)
+	}
+	buf := &bytes.Buffer{}
+	m.files[filename] = buf
+	m.order = append(m.order, filename)
+	return writerFunc(buf.Write), nil
+}
+
+func (m *memFiles) names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.files))
+	for name := range m.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newTestService returns a service retrieving msgs through MessageFetcher,
+// without calling Gmail, and writing attachments to files. Unknown IDs fail
+// with 404 Not Found
+func newTestService(files *memFiles, msgs ...*gmail.Message) *Service {
+	byID := make(map[string]*gmail.Message, len(msgs))
+	for _, msg := range msgs {
+		byID[msg.Id] = msg
+	}
+	return &Service{
+		UserID: "me",
+		MessageFetcher: func(ctx context.Context, msgID string) (*gmail.Message, error) {
+			msg, ok := byID[msgID]
+			if !ok {
+				return nil, &googleapi.Error{Code: http.StatusNotFound, Message: "Not Found"}
+			}
+			return msg, nil
+		},
+		WriterGenerator: files.generator,
+		Stats:           &Stats{RunID: "run"},
+	}
+}
+
+// listed returns the messages as ListMessages would, by ID only
+func listed(msgs ...*gmail.Message) []*gmail.Message {
+	ids := make([]*gmail.Message, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = &gmail.Message{Id: msg.Id, ThreadId: msg.ThreadId}
+	}
+	return ids
+}
+
+// tempDir returns a new directory and a function removing it
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "gmail-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestNotifyProcessed(t *testing.T) {
+	msgs := []*gmail.Message{{Id: "a"}, {Id: "b"}, {Id: "c"}}
+	tests := []struct {
+		name string
+		err  error
+		want []string
+	}{
+		{name: "all marked", want: []string{"a", "b", "c"}},
+		{name: "chunk failed", err: &ModifyError{MessageIDs: []string{"b"}, Err: errors.New("backend error")}, want: []string{"a", "c"}},
+		{name: "wrapped", err: fmt.Errorf("mark read: %w", &ModifyError{MessageIDs: []string{"a", "c"}}), want: []string{"b"}},
+		{name: "unknown failure", err: errors.New("canceled")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			srv := &Service{OnMessageProcessed: func(msgID string) { got = append(got, msgID) }}
+			srv.notifyProcessed(msgs, tt.err)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("notified %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// failingWriter fails every write, recording how it is released
+type failingWriter struct {
+	closed  bool
+	aborted error
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func (w *failingWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+// abortingWriter is a failingWriter that can be aborted
+type abortingWriter struct {
+	failingWriter
+}
+
+func (w *abortingWriter) Abort(err error) error {
+	w.aborted = err
+	return nil
+}
+
+func TestProcessAttachmentReleasesFailedWriter(t *testing.T) {
+	closing := &failingWriter{}
+	aborting := &abortingWriter{}
+	tests := []struct {
+		name string
+		w    io.Writer
+	}{
+		{name: "closer", w: closing},
+		{name: "aborter", w: aborting},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := pdfMessage("m", time.Now(), "a.pdf")
+			srv := newTestService(&memFiles{}, msg)
+			srv.WriterGenerator = func(string) (io.Writer, error) { return tt.w, nil }
+			part := &attachmentPart{MessagePart: msg.Payload.Parts[0]}
+			if _, err := srv.processAttachment(context.Background(), msg, part); err == nil {
+				t.Fatal("failed write returned no error")
+			}
+		})
+	}
+	if !closing.closed {
+		t.Error("writer not closed")
+	}
+	if aborting.aborted == nil || aborting.closed {
+		t.Errorf("writer aborted with %v, closed %t", aborting.aborted, aborting.closed)
+	}
+}
+
+// fakeGmail serves the Gmail API endpoints used by runs from msgs
+type fakeGmail struct {
+	*httptest.Server
+
+	mu   sync.Mutex
+	msgs []*gmail.Message
+	// nextPageToken is returned when listing, as if more pages followed
+	nextPageToken string
+	// pageSize, when set, splits the listed messages into pages
+	pageSize int
+	// modified collects the IDs of batch modify requests
+	modified []string
+	// modifications collects the batch modify requests
+	modifications []*gmail.BatchModifyMessagesRequest
+	// requests logs the method and path of every request received
+	requests []string
+	// trashed collects the IDs of trashed messages
+	trashed []string
+	// attachments holds the data returned by attachment ID, any other
+	// attachment request fails
+	attachments map[string]string
+	// labels are returned when listing labels
+	labels []*gmail.Label
+	// rejectModify fails every batch modify request
+	rejectModify bool
+}
+
+func newFakeGmail(msgs ...*gmail.Message) *fakeGmail {
+	f := &fakeGmail{msgs: msgs}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeGmail) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path+"?"+r.URL.RawQuery)
+	path := strings.TrimPrefix(r.URL.Path, "/gmail/v1/users/me/")
+	switch {
+	case path == "messages" && r.Method == http.MethodGet:
+		rep := &gmail.ListMessagesResponse{NextPageToken: f.nextPageToken}
+		page := f.msgs
+		if f.pageSize > 0 {
+			start, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+			end := start + f.pageSize
+			if end < len(page) {
+				rep.NextPageToken = strconv.Itoa(end)
+			} else {
+				end = len(page)
+			}
+			page = page[start:end]
+		}
+		for _, msg := range page {
+			rep.Messages = append(rep.Messages, &gmail.Message{Id: msg.Id, ThreadId: msg.ThreadId})
+		}
+		json.NewEncoder(w).Encode(rep)
+	case path == "labels" && r.Method == http.MethodGet:
+		json.NewEncoder(w).Encode(&gmail.ListLabelsResponse{Labels: f.labels})
+	case path == "messages/batchModify" && f.rejectModify:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":{"code":400,"message":"Invalid label"}}`))
+	case path == "messages/batchModify":
+		req := &gmail.BatchModifyMessagesRequest{}
+		json.NewDecoder(r.Body).Decode(req)
+		f.modified = append(f.modified, req.Ids...)
+		f.modifications = append(f.modifications, req)
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasSuffix(path, "/trash") && r.Method == http.MethodPost:
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "messages/"), "/trash")
+		f.trashed = append(f.trashed, id)
+		json.NewEncoder(w).Encode(&gmail.Message{Id: id})
+	case strings.Contains(path, "/attachments/"):
+		if data, ok := f.attachments[path[strings.LastIndex(path, "/")+1:]]; ok {
+			json.NewEncoder(w).Encode(&gmail.MessagePartBody{Data: data, Size: int64(len(data))})
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"error":{"code":503,"message":"Backend Error"}}`))
+	case strings.HasPrefix(path, "messages/"):
+		id := strings.TrimPrefix(path, "messages/")
+		for _, msg := range f.msgs {
+			if msg.Id == id {
+				if r.URL.Query().Get("format") == "metadata" {
+					msg = metadataOnly(msg, r.URL.Query()["metadataHeaders"])
+				}
+				json.NewEncoder(w).Encode(msg)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":{"code":404,"message":"Requested entity was not found."}}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// metadataOnly returns msg as Gmail does in metadata format: with the
+// headers named, but without parts or bodies
+func metadataOnly(msg *gmail.Message, names []string) *gmail.Message {
+	m := *msg
+	m.Payload = &gmail.MessagePart{MimeType: msg.Payload.MimeType}
+	for _, header := range msg.Payload.Headers {
+		for _, name := range names {
+			if strings.EqualFold(header.Name, name) {
+				m.Payload.Headers = append(m.Payload.Headers, header)
+			}
+		}
+	}
+	return &m
+}
+
+// service returns a service calling f, retrieving messages and writing
+// attachments to files
+func (f *fakeGmail) service(t *testing.T, files *memFiles) *Service {
+	gmailSrv, err := gmail.NewService(context.Background(),
+		option.WithHTTPClient(f.Client()),
+		option.WithEndpoint(f.URL+"/gmail/v1/users/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Service{UserID: "me", RunID: "run"}
+	srv.setDefaults(gmailSrv, f.Client())
+	srv.WriterGenerator = files.generator
+	return srv
+}
+
+// requested returns the requests received whose path contains pattern
+func (f *fakeGmail) requested(pattern string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var matching []string
+	for _, req := range f.requests {
+		if strings.Contains(req, pattern) {
+			matching = append(matching, req)
+		}
+	}
+	return matching
+}
+
+// markedRead returns the IDs of the messages marked as read
+func (f *fakeGmail) markedRead() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.modified...)
+}
+
+func TestIfNewerOutputPath(t *testing.T) {
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		modTime   time.Time
+		wantWrite bool
+	}{
+		{name: "up to date", modTime: date.Add(time.Hour)},
+		{name: "stale", modTime: date.Add(-time.Hour), wantWrite: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, cleanup := tempDir(t)
+			defer cleanup()
+			msg := pdfMessage("m", date, "a.pdf")
+			existing := filepath.Join(dir, constructFilename(msg.Payload.Parts[0], msg, nil))
+			if err := ioutil.WriteFile(existing, []byte("old"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(existing, tt.modTime, tt.modTime); err != nil {
+				t.Fatal(err)
+			}
+
+			srv := newTestService(&memFiles{}, msg)
+			srv.Overwrite = IfNewer
+			srv.AttachmentWriterGenerator = DirGenerator(dir, false)
+			srv.OutputPath = DirPath(dir, false)
+
+			att, err := srv.processAttachment(context.Background(), msg, &attachmentPart{MessagePart: msg.Payload.Parts[0]})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if att != nil {
+				att.Body.(io.Closer).Close()
+			}
+			if written := att != nil; written != tt.wantWrite {
+				t.Errorf("written = %t, want %t", written, tt.wantWrite)
+			}
+			if att != nil && att.Path != existing {
+				t.Errorf("path = %s, want %s", att.Path, existing)
+			}
+		})
+	}
+}
+
+func TestRetrieveBodyCancelledBackoff(t *testing.T) {
+	fake := newFakeGmail()
+	defer fake.Close()
+	srv := fake.service(t, &memFiles{})
+	srv.AttachmentRetries = 5
+	defer func(backoff time.Duration) { attachmentBackoff = backoff }(attachmentBackoff)
+	attachmentBackoff = time.Minute
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	part := &gmail.MessagePart{PartId: "0", Body: &gmail.MessagePartBody{AttachmentId: "att", Size: 10}}
+	start := time.Now()
+	_, err := srv.retrieveBody(ctx, &gmail.Message{Id: "m"}, part)
+	if err != context.DeadlineExceeded {
+		t.Errorf("error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("returned after %s", elapsed)
+	}
+}
+
+func TestOnWriterError(t *testing.T) {
+	defer func(backoff time.Duration) { writerBackoff = backoff }(writerBackoff)
+	writerBackoff = time.Millisecond
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		policy  WriterErrorPolicy
+		retries int
+		// failures is how many times the generator fails for x.pdf, -1 for
+		// always
+		failures  int
+		wantErr   bool
+		wantCalls int
+		wantFiles int
+	}{
+		{name: "skip", policy: Skip, failures: -1, wantCalls: 1, wantFiles: 1},
+		{name: "fail", policy: Fail, failures: -1, wantErr: true, wantCalls: 1},
+		{name: "retry exhausted", policy: Retry, retries: 2, failures: -1, wantCalls: 3, wantFiles: 1},
+		{name: "retry recovers", policy: Retry, retries: 2, failures: 1, wantCalls: 2, wantFiles: 2},
+		{name: "skip ignores retries", policy: Skip, retries: 2, failures: -1, wantCalls: 1, wantFiles: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs := []*gmail.Message{pdfMessage("bad", date, "x.pdf"), pdfMessage("good", date, "y.pdf")}
+			files := &memFiles{}
+			srv := newTestService(files, msgs...)
+			srv.OnWriterError = tt.policy
+			srv.WriterRetries = tt.retries
+			calls := 0
+			srv.WriterGenerator = func(name string) (io.Writer, error) {
+				if strings.HasPrefix(name, "x.pdf") {
+					calls++
+					if tt.failures < 0 || calls <= tt.failures {
+						return nil, errors.New("disk unavailable")
+					}
+				}
+				return files.generator(name)
+			}
+
+			_, _, err := srv.processMessages(context.Background(), listed(msgs...), false)
+			var writerErr *WriterError
+			if got := errors.As(err, &writerErr); got != tt.wantErr {
+				t.Errorf("err = %v, want a WriterError: %t", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("generator called %d times, want %d", calls, tt.wantCalls)
+			}
+			if n := len(files.names()); n != tt.wantFiles {
+				t.Errorf("wrote %d files, want %d", n, tt.wantFiles)
+			}
+			if wantRecorded := tt.wantFiles < 2; !tt.wantErr && (len(srv.Stats.Errors) == 1) != wantRecorded {
+				t.Errorf("recorded errors %v", srv.Stats.Errors)
+			}
+		})
+	}
+}
+
+func TestTrashMessage(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		t.Run(fmt.Sprintf("dry run %t", dryRun), func(t *testing.T) {
+			fake := newFakeGmail()
+			defer fake.Close()
+			srv := fake.service(t, &memFiles{})
+			srv.DryRun = dryRun
+
+			if err := srv.TrashMessage(context.Background(), "m1"); err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			if !dryRun {
+				want = []string{"m1"}
+			}
+			if fmt.Sprint(fake.trashed) != fmt.Sprint(want) {
+				t.Errorf("trashed %v, want %v", fake.trashed, want)
+			}
+			if n := len(fake.requested("/")); dryRun && n > 0 {
+				t.Errorf("dry run sent %d requests", n)
+			}
+		})
+	}
+}
+
+func TestMarkAsReadEmpty(t *testing.T) {
+	fake := newFakeGmail()
+	defer fake.Close()
+	srv := fake.service(t, &memFiles{})
+
+	for _, msgs := range [][]*gmail.Message{nil, {}} {
+		if err := markAsRead(context.Background(), srv.srv, srv.UserID, msgs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reqs := fake.requested("batchModify"); len(reqs) > 0 {
+		t.Errorf("sent %v", reqs)
+	}
+	if err := markAsRead(context.Background(), srv.srv, srv.UserID, []*gmail.Message{{Id: "m1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if reqs := fake.requested("batchModify"); len(reqs) != 1 {
+		t.Errorf("sent %v, want a single batch modify", reqs)
+	}
+}
+
+func TestProcessMessageIDs(t *testing.T) {
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	for _, markRead := range []bool{true, false} {
+		t.Run(fmt.Sprintf("mark read %t", markRead), func(t *testing.T) {
+			fake := newFakeGmail(pdfMessage("a", date, "a.pdf"), pdfMessage("b", date, "b.pdf"))
+			defer fake.Close()
+			files := &memFiles{}
+			srv := fake.service(t, files)
+
+			res, err := srv.ProcessMessageIDs(context.Background(), []string{"a", "missing", "", "b"}, markRead)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, att := range res.Attachments {
+				got = append(got, att.MessageID)
+			}
+			if fmt.Sprint(got) != "[a b]" {
+				t.Errorf("attachments of %v, want [a b]", got)
+			}
+			if fmt.Sprint(res.Stats.Vanished) != "[missing]" || res.Stats.InvalidMessages != 1 {
+				t.Errorf("vanished %v, invalid %d", res.Stats.Vanished, res.Stats.InvalidMessages)
+			}
+			want := "[]"
+			if markRead {
+				want = "[a b]"
+			}
+			if got := fmt.Sprint(fake.markedRead()); got != want {
+				t.Errorf("marked read %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestScanQuarantine(t *testing.T) {
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		markRead bool
+		want     string
+	}{
+		{name: "left unread", want: "[clean]"},
+		{name: "marked read", markRead: true, want: "[clean infected]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeGmail(pdfMessage("clean", date, "a.pdf"), pdfMessage("infected", date, "b.pdf", "c.pdf"))
+			defer fake.Close()
+			files := &memFiles{}
+			srv := fake.service(t, files)
+			srv.MarkQuarantinedRead = tt.markRead
+			var scanned []string
+			srv.Scan = func(name string, r io.Reader) error {
+				data, _ := ioutil.ReadAll(r)
+				scanned = append(scanned, string(data))
+				if strings.HasPrefix(name, "b.pdf") {
+					return errors.New("EICAR test signature")
+				}
+				return nil
+			}
+
+			atts, err := srv.ProcessPDFAttachments(true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(scanned) != 3 || scanned[1] != "%PDF-1.4 infected/b.pdf" {
+				t.Errorf("scanned %q", scanned)
+			}
+			for _, name := range files.names() {
+				if strings.HasPrefix(name, "b.pdf") {
+					t.Errorf("quarantined attachment written to %s", name)
+				}
+			}
+			if len(files.names()) != 2 {
+				t.Errorf("wrote %v, want the two clean attachments", files.names())
+			}
+			var quarantined []string
+			for _, att := range atts {
+				if att.Quarantined != nil {
+					quarantined = append(quarantined, att.OriginalName)
+				}
+			}
+			if fmt.Sprint(quarantined) != "[b.pdf]" || srv.Stats.Quarantined != 1 {
+				t.Errorf("quarantined %v, counted %d", quarantined, srv.Stats.Quarantined)
+			}
+			if got := fmt.Sprint(fake.markedRead()); got != tt.want {
+				t.Errorf("marked read %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeClock replaces clockNow and clockAfter, recording the waits asked for
+// and ending them at once. The returned function restores the real clock
+func fakeClock(now time.Time) (waits *[]time.Duration, restore func()) {
+	waits = &[]time.Duration{}
+	var mu sync.Mutex
+	clockNow = func() time.Time { return now }
+	clockAfter = func(d time.Duration) <-chan time.Time {
+		mu.Lock()
+		*waits = append(*waits, d)
+		mu.Unlock()
+		ch := make(chan time.Time, 1)
+		ch <- now
+		return ch
+	}
+	return waits, func() {
+		clockNow = time.Now
+		clockAfter = time.After
+	}
+}
+
+func TestClock(t *testing.T) {
+	now := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+
+	t.Run("attachment retries", func(t *testing.T) {
+		waits, restore := fakeClock(now)
+		defer restore()
+		fake := newFakeGmail()
+		defer fake.Close()
+		srv := fake.service(t, &memFiles{})
+		srv.AttachmentRetries = 3
+
+		part := &gmail.MessagePart{PartId: "0", Body: &gmail.MessagePartBody{AttachmentId: "att", Size: 10}}
+		if _, err := srv.retrieveBody(context.Background(), &gmail.Message{Id: "m"}, part); err == nil {
+			t.Fatal("retrieved from a failing server")
+		}
+		if got := fmt.Sprint(*waits); got != "[1s 2s 4s]" {
+			t.Errorf("waited %s, want [1s 2s 4s]", got)
+		}
+	})
+
+	t.Run("writer retries", func(t *testing.T) {
+		waits, restore := fakeClock(now)
+		defer restore()
+		srv := &Service{OnWriterError: Retry, WriterRetries: 2, Stats: &Stats{}}
+		srv.WriterGenerator = func(string) (io.Writer, error) { return nil, errors.New("disk unavailable") }
+		if _, err := srv.newWriter(context.Background(), &ProcessedAttachment{Filename: "a.pdf"}); err == nil {
+			t.Fatal("generator failures not returned")
+		}
+		if got := fmt.Sprint(*waits); got != "[1s 2s]" {
+			t.Errorf("waited %s, want [1s 2s]", got)
+		}
+	})
+
+	t.Run("retry after date", func(t *testing.T) {
+		_, restore := fakeClock(now)
+		defer restore()
+		header := http.Header{"Retry-After": {now.Add(90 * time.Second).Format(http.TimeFormat)}}
+		if got := retryAfter(header); got != 90*time.Second {
+			t.Errorf("retryAfter = %s, want 1m30s", got)
+		}
+	})
+
+	t.Run("service time", func(t *testing.T) {
+		_, restore := fakeClock(now)
+		defer restore()
+		if got := (&Service{}).timeNow(); !got.Equal(now) {
+			t.Errorf("timeNow = %s, want %s", got, now)
+		}
+		later := now.Add(time.Hour)
+		if got := (&Service{now: func() time.Time { return later }}).timeNow(); !got.Equal(later) {
+			t.Errorf("timeNow = %s, want %s", got, later)
+		}
+	})
+}
+
+func TestListMessagesOrder(t *testing.T) {
+	// Gmail lists the most recent messages first
+	var msgs []*gmail.Message
+	for i := 5; i > 0; i-- {
+		date := time.Date(2020, 1, i, 0, 0, 0, 0, time.UTC)
+		msgs = append(msgs, pdfMessage(fmt.Sprintf("m%d", i), date, "a.pdf"))
+	}
+	fake := newFakeGmail(msgs...)
+	defer fake.Close()
+	fake.pageSize = 2
+
+	tests := []struct {
+		order MessageOrder
+		want  string
+		pages int
+	}{
+		{order: Newest, want: "[m5 m4]", pages: 1},
+		{order: Oldest, want: "[m1 m2 m3 m4 m5]", pages: 3},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.order), func(t *testing.T) {
+			fake.mu.Lock()
+			fake.requests = nil
+			fake.mu.Unlock()
+			srv := fake.service(t, &memFiles{})
+			srv.Order = tt.order
+
+			listed, err := srv.ListMessagesContext(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, msg := range listed {
+				ids = append(ids, msg.Id)
+			}
+			if got := fmt.Sprint(ids); got != tt.want {
+				t.Errorf("listed %s, want %s", got, tt.want)
+			}
+			if n := len(fake.requested("/messages?")); n != tt.pages {
+				t.Errorf("listed %d pages, want %d", n, tt.pages)
+			}
+
+			atts, err := srv.ProcessPDFAttachments(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = nil
+			for _, att := range atts {
+				ids = append(ids, att.MessageID)
+			}
+			if got := fmt.Sprint(ids); got != tt.want {
+				t.Errorf("processed %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("cancelled", func(t *testing.T) {
+		srv := fake.service(t, &memFiles{})
+		srv.Order = Oldest
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := srv.ListMessagesContext(ctx); !errors.Is(err, context.Canceled) {
+			t.Errorf("err = %v, want %v", err, context.Canceled)
+		}
+	})
+}
+
+func TestFailFast(t *testing.T) {
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		// brokenFetch fails retrieving m2 rather than decoding its attachment
+		brokenFetch bool
+		failFast    bool
+		wantFiles   string
+	}{
+		{name: "decode", failFast: true, wantFiles: "[a.pdf-m1-0.pdf]"},
+		{name: "retrieve", brokenFetch: true, failFast: true, wantFiles: "[a.pdf-m1-0.pdf]"},
+		{name: "carry on", wantFiles: "[a.pdf-m1-0.pdf a.pdf-m3-0.pdf]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broken := pdfMessage("m2", date, "a.pdf")
+			broken.Payload.Parts[0].Body.Data = "not base64!"
+			msgs := []*gmail.Message{pdfMessage("m1", date, "a.pdf"), broken, pdfMessage("m3", date, "a.pdf")}
+			files := &memFiles{}
+			srv := newTestService(files, msgs...)
+			srv.FailFast = tt.failFast
+			if tt.brokenFetch {
+				fetch := srv.MessageFetcher
+				srv.MessageFetcher = func(ctx context.Context, msgID string) (*gmail.Message, error) {
+					if msgID == "m2" {
+						return nil, errors.New("backend error")
+					}
+					return fetch(ctx, msgID)
+				}
+			}
+
+			_, _, err := srv.processMessages(context.Background(), listed(msgs...), false)
+			if tt.failFast {
+				if err == nil || !strings.Contains(err.Error(), "m2") {
+					t.Errorf("err = %v, want the failure of m2", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprint(files.names()); got != tt.wantFiles {
+				t.Errorf("wrote %s, want %s", got, tt.wantFiles)
+			}
+		})
+	}
+}
+
+func TestMarkReadOnlyOnFullSuccess(t *testing.T) {
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		fullSuccess bool
+		want        string
+	}{
+		{name: "partial", want: "[good]"},
+		{name: "full success", fullSuccess: true, want: "[]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broken := pdfMessage("broken", date, "b.pdf")
+			broken.Payload.Parts[0].Body.Data = "not base64!"
+			fake := newFakeGmail(pdfMessage("good", date, "a.pdf"), broken)
+			defer fake.Close()
+			files := &memFiles{}
+			srv := fake.service(t, files)
+			srv.MarkReadOnlyOnFullSuccess = tt.fullSuccess
+
+			if _, err := srv.ProcessPDFAttachments(true); err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprint(fake.markedRead()); got != tt.want {
+				t.Errorf("marked %s as read, want %s", got, tt.want)
+			}
+			if n := len(files.names()); n != 1 {
+				t.Errorf("wrote %d files, want the good one", n)
+			}
+		})
+	}
+}
+
+func TestInlineBodyData(t *testing.T) {
+	defer func(backoff time.Duration) { attachmentBackoff = backoff }(attachmentBackoff)
+	attachmentBackoff = time.Millisecond
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	both := pdfMessage("both", date, "a.pdf")
+	both.Payload.Parts[0].Body.AttachmentId = "att-a"
+	referenced := pdfMessage("referenced", date, "b.pdf")
+	referenced.Payload.Parts[0].Body.AttachmentId = "att-b"
+	referenced.Payload.Parts[0].Body.Data = ""
+	fake := newFakeGmail(both, referenced)
+	defer fake.Close()
+	files := &memFiles{}
+	srv := fake.service(t, files)
+
+	if _, err := srv.ProcessPDFAttachments(false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(files.names()), "[a.pdf-both-0.pdf]"; got != want {
+		t.Errorf("wrote %s, want %s", got, want)
+	}
+	// the fake fails every attachment request
+	if len(fake.requested("/messages/both/attachments/")) != 0 {
+		t.Error("retrieved the attachment of inline data")
+	}
+	if len(fake.requested("/messages/referenced/attachments/att-b")) == 0 {
+		t.Error("didn't retrieve the attachment without data")
+	}
+}
+
+func TestProcessMessagesCancelled(t *testing.T) {
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	msgs := []*gmail.Message{pdfMessage("m1", date, "a.pdf"), pdfMessage("m2", date, "b.pdf"), pdfMessage("m3", date, "c.pdf")}
+	files := &memFiles{}
+	srv := newTestService(files, msgs...)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// cancel once the first message is being written
+	srv.WriterGenerator = func(name string) (io.Writer, error) {
+		cancel()
+		return files.generator(name)
+	}
+
+	atts, _, err := srv.processMessages(ctx, listed(msgs...), false)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+	if len(atts) != 1 || atts[0].MessageID != "m1" {
+		t.Errorf("returned %d attachments, want that of m1", len(atts))
+	}
+	if got, want := fmt.Sprint(files.names()), "[a.pdf-m1-0.pdf]"; got != want {
+		t.Errorf("wrote %s, want %s", got, want)
+	}
+}
+
+func TestEmptyAttachmentData(t *testing.T) {
+	defer func(backoff time.Duration) { attachmentBackoff = backoff }(attachmentBackoff)
+	attachmentBackoff = time.Millisecond
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	hiccup := pdfMessage("hiccup", date, "a.pdf")
+	hiccup.Payload.Parts[0].Body = &gmail.MessagePartBody{AttachmentId: "att-a", Size: 20}
+	empty := pdfMessage("empty", date, "b.pdf")
+	empty.Payload.Parts[0].Body = &gmail.MessagePartBody{AttachmentId: "att-b"}
+	fake := newFakeGmail(hiccup, empty)
+	defer fake.Close()
+	fake.attachments = map[string]string{"att-a": "", "att-b": ""}
+	files := &memFiles{}
+	srv := fake.service(t, files)
+	srv.AttachmentRetries = 2
+	var mu sync.Mutex
+	var failed []string
+	srv.OnError = func(msgID, partID string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if errors.Is(err, ErrEmptyAttachment) {
+			failed = append(failed, msgID)
+		}
+	}
+
+	if _, err := srv.ProcessPDFAttachments(true); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(failed), "[hiccup]"; got != want {
+		t.Errorf("%v failed for %s, want %s", ErrEmptyAttachment, got, want)
+	}
+	if n := len(fake.requested("/attachments/att-a")); n != 3 {
+		t.Errorf("retrieved the attachment %d times, want 3", n)
+	}
+	// an attachment that is empty is written
+	if got, want := fmt.Sprint(files.names()), "[b.pdf-empty-0.pdf]"; got != want {
+		t.Errorf("wrote %s, want %s", got, want)
+	}
+	if got, want := fmt.Sprint(fake.markedRead()), "[empty]"; got != want {
+		t.Errorf("marked %s as read, want %s", got, want)
+	}
+}
+
+func TestOnError(t *testing.T) {
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	broken := pdfMessage("m1", date, "a.pdf", "b.pdf")
+	broken.Payload.Parts[1].Body.Data = "not base64!"
+	msgs := []*gmail.Message{broken, pdfMessage("m2", date, "c.pdf")}
+	files := &memFiles{}
+	srv := newTestService(files, msgs...)
+	var reported []string
+	srv.OnError = func(msgID, partID string, err error) {
+		reported = append(reported, msgID+"/"+partID)
+	}
+
+	if _, _, err := srv.processMessages(context.Background(), listed(msgs...), false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(reported), "[m1/1]"; got != want {
+		t.Errorf("reported %s, want %s", got, want)
+	}
+	if len(srv.Stats.Errors) != 1 || srv.Stats.Errors[0].MessageID != "m1" || srv.Stats.Errors[0].PartID != "1" {
+		t.Errorf("recorded errors %v", srv.Stats.Errors)
+	}
+	// the run carries on with the next message
+	if got, want := fmt.Sprint(files.names()), "[a.pdf-m1-0.pdf c.pdf-m2-0.pdf]"; got != want {
+		t.Errorf("wrote %s, want %s", got, want)
+	}
+}
+
+func TestSelectPerMessage(t *testing.T) {
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		selection PartSelection
+		want      string
+	}{
+		{name: "all", selection: All, want: "[a.pdf-m1-0.pdf b.pdf-m2-0.pdf bigger.pdf-m1-1.pdf c.pdf-m1-2.pdf]"},
+		{name: "first", selection: First, want: "[a.pdf-m1-0.pdf b.pdf-m2-0.pdf]"},
+		{name: "largest", selection: Largest, want: "[b.pdf-m2-0.pdf bigger.pdf-m1-1.pdf]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs := []*gmail.Message{pdfMessage("m1", date, "a.pdf", "bigger.pdf", "c.pdf"), pdfMessage("m2", date, "b.pdf")}
+			files := &memFiles{}
+			srv := newTestService(files, msgs...)
+			srv.SelectPerMessage = tt.selection
+			if _, _, err := srv.processMessages(context.Background(), listed(msgs...), false); err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprint(files.names()); got != tt.want {
+				t.Errorf("wrote %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarkUnread(t *testing.T) {
+	ids := make([]string, maxBatchModifyIds+1)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("m%d", i)
+	}
+	for _, dryRun := range []bool{false, true} {
+		t.Run(fmt.Sprintf("dry run %t", dryRun), func(t *testing.T) {
+			fake := newFakeGmail()
+			defer fake.Close()
+			srv := fake.service(t, &memFiles{})
+			srv.DryRun = dryRun
+			if err := srv.MarkUnread(context.Background(), ids); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, req := range fake.modifications {
+				got = append(got, fmt.Sprintf("%d +%v -%v", len(req.Ids), req.AddLabelIds, req.RemoveLabelIds))
+			}
+			want := "[1000 +[UNREAD] -[] 1 +[UNREAD] -[]]"
+			if dryRun {
+				want = "[]"
+			}
+			if fmt.Sprint(got) != want {
+				t.Errorf("modifications %v, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestMinAttachmentBytes(t *testing.T) {
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	msg := pdfMessage("m1", date, "small.pdf", "exact.pdf", "large.pdf")
+	fake := newFakeGmail(msg)
+	defer fake.Close()
+	fake.attachments = make(map[string]string)
+	for i, part := range msg.Payload.Parts {
+		id := fmt.Sprintf("att-%d", i)
+		fake.attachments[id] = part.Body.Data
+		part.Body = &gmail.MessagePartBody{AttachmentId: id, Size: int64(9 + i)}
+	}
+	files := &memFiles{}
+	srv := fake.service(t, files)
+	srv.MinAttachmentBytes = 10
+
+	if _, err := srv.ProcessPDFAttachments(false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(files.names()), "[exact.pdf-m1-1.pdf large.pdf-m1-2.pdf]"; got != want {
+		t.Errorf("wrote %s, want %s", got, want)
+	}
+	if len(fake.requested("/attachments/att-0")) != 0 {
+		t.Error("retrieved the attachment below the minimum")
+	}
+	if srv.Stats.SkippedTooSmall != 1 {
+		t.Errorf("skipped %d as too small, want 1", srv.Stats.SkippedTooSmall)
+	}
+}
+
+func TestAttachmentDurations(t *testing.T) {
+	msg := pdfMessage("m1", time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), "a.pdf", "b.pdf")
+	srv := newTestService(&memFiles{}, msg)
+	// each reading of the clock advances it further than the last
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	step := time.Duration(0)
+	srv.now = func() time.Time {
+		step += time.Millisecond
+		now = now.Add(step)
+		return now
+	}
+
+	atts, _, err := srv.processMessages(context.Background(), listed(msg), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, att := range atts {
+		got = append(got, fmt.Sprintf("%s %s/%s", att.OriginalName, att.FetchDuration, att.DecodeDuration))
+	}
+	if want := "[a.pdf 2ms/6ms b.pdf 4ms/8ms]"; fmt.Sprint(got) != want {
+		t.Errorf("durations %v, want %s", got, want)
+	}
+	fetch, decode := srv.Stats.Fetch, srv.Stats.Decode
+	if fetch.Min != 2*time.Millisecond || fetch.Max != 4*time.Millisecond || fetch.Avg() != 3*time.Millisecond || fetch.Count != 2 {
+		t.Errorf("fetch stats %+v", fetch)
+	}
+	if decode.Min != 6*time.Millisecond || decode.Max != 8*time.Millisecond || decode.Avg() != 7*time.Millisecond {
+		t.Errorf("decode stats %+v", decode)
+	}
+}
+
+func TestOnMessageProcessed(t *testing.T) {
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	for _, reject := range []bool{false, true} {
+		t.Run(fmt.Sprintf("rejected %t", reject), func(t *testing.T) {
+			fake := newFakeGmail(pdfMessage("m1", date, "a.pdf"), pdfMessage("m2", date, "b.pdf"))
+			defer fake.Close()
+			fake.rejectModify = reject
+			srv := fake.service(t, &memFiles{})
+			var notified []string
+			srv.OnMessageProcessed = func(msgID string) { notified = append(notified, msgID) }
+
+			_, err := srv.ProcessPDFAttachments(true)
+			want := "[m1 m2]"
+			if reject {
+				var modErr *ModifyError
+				if !errors.As(err, &modErr) {
+					t.Errorf("err = %v, want a ModifyError", err)
+				}
+				want = "[]"
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprint(notified); got != want {
+				t.Errorf("notified %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestContentLocationUnresolved(t *testing.T) {
+	msg := pdfMessage("m1", time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), "a.pdf", "b.pdf")
+	location := &gmail.MessagePartHeader{Name: "Content-Location", Value: "https://files.example.com/statement.pdf"}
+	// the first part also carries its content, so isn't unresolved
+	msg.Payload.Parts[0].Headers = []*gmail.MessagePartHeader{location}
+	msg.Payload.Parts = append(msg.Payload.Parts, &gmail.MessagePart{
+		PartId:   "2",
+		MimeType: "application/pdf",
+		Headers:  []*gmail.MessagePartHeader{location},
+		Body:     &gmail.MessagePartBody{},
+	}, &gmail.MessagePart{
+		PartId:   "3",
+		MimeType: "image/png",
+		Headers:  []*gmail.MessagePartHeader{{Name: "Content-Location", Value: "cid:logo"}},
+		Body:     &gmail.MessagePartBody{},
+	})
+	files := &memFiles{}
+	srv := newTestService(files, msg)
+
+	if _, _, err := srv.processMessages(context.Background(), listed(msg), false); err != nil {
+		t.Fatal(err)
+	}
+	want := []UnresolvedPart{
+		{MessageID: "m1", PartID: "2", MimeType: "application/pdf", Location: location.Value},
+		{MessageID: "m1", PartID: "3", MimeType: "image/png", Location: "cid:logo"},
+	}
+	if !reflect.DeepEqual(srv.Stats.Unresolved, want) {
+		t.Errorf("unresolved %+v, want %+v", srv.Stats.Unresolved, want)
+	}
+	if got, want := fmt.Sprint(files.names()), "[a.pdf-m1-0.pdf b.pdf-m1-1.pdf]"; got != want {
+		t.Errorf("wrote %s, want %s", got, want)
+	}
+}
+
+func TestSharedAttachmentID(t *testing.T) {
+	msg := pdfMessage("m1", time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), "a.pdf", "copy.pdf")
+	fake := newFakeGmail(msg)
+	defer fake.Close()
+	fake.attachments = map[string]string{"att-a": msg.Payload.Parts[0].Body.Data}
+	for _, part := range msg.Payload.Parts {
+		part.Body = &gmail.MessagePartBody{AttachmentId: "att-a", Size: part.Body.Size}
+	}
+	files := &memFiles{}
+	srv := fake.service(t, files)
+
+	if _, err := srv.ProcessPDFAttachments(false); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(fake.requested("/attachments/att-a")); n != 1 {
+		t.Errorf("retrieved the shared attachment %d times, want once", n)
+	}
+	if srv.Stats.AttachmentCacheHits != 1 {
+		t.Errorf("%d cache hits, want 1", srv.Stats.AttachmentCacheHits)
+	}
+	for _, name := range []string{"a.pdf-m1-0.pdf", "copy.pdf-m1-1.pdf"} {
+		if got := files.files[name].String(); got != "%PDF-1.4 m1/a.pdf" {
+			t.Errorf("wrote %q to %s", got, name)
+		}
+	}
+}
+
+func TestHadUnmatchedAttachments(t *testing.T) {
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	zipped := pdfMessage("zipped", date, "statements.zip")
+	mixed := pdfMessage("mixed", date, "a.pdf", "archive.zip")
+	for _, part := range []*gmail.MessagePart{zipped.Payload.Parts[0], mixed.Payload.Parts[1]} {
+		part.MimeType = "application/zip"
+		part.Headers = []*gmail.MessagePartHeader{{Name: "Content-Disposition", Value: "attachment"}}
+	}
+	msgs := []*gmail.Message{zipped, mixed}
+	files := &memFiles{}
+	srv := newTestService(files, msgs...)
+
+	if _, _, err := srv.processMessages(context.Background(), listed(msgs...), false); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(srv.Stats.HadUnmatchedAttachments); got != "[zipped]" {
+		t.Errorf("messages without a match %s, want [zipped]", got)
+	}
+	if srv.Stats.UnmatchedAttachments != 2 {
+		t.Errorf("%d unmatched attachments, want 2", srv.Stats.UnmatchedAttachments)
+	}
+	if got, want := fmt.Sprint(files.names()), "[a.pdf-mixed-0.pdf]"; got != want {
+		t.Errorf("wrote %s, want %s", got, want)
+	}
+}
+
+func TestMessageWithoutID(t *testing.T) {
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	fake := newFakeGmail(pdfMessage("", date, "x.pdf"), pdfMessage("m1", date, "a.pdf"))
+	defer fake.Close()
+	files := &memFiles{}
+	srv := fake.service(t, files)
+
+	atts, err := srv.ProcessPDFAttachmentsContext(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(atts) != 1 || fmt.Sprint(files.names()) != "[a.pdf-m1-0.pdf]" {
+		t.Errorf("wrote %v", files.names())
+	}
+	if srv.Stats.InvalidMessages != 1 {
+		t.Errorf("invalid messages %d, want 1", srv.Stats.InvalidMessages)
+	}
+	if got := fake.requested("/messages/?"); len(got) != 0 {
+		t.Errorf("requested the message without an ID: %v", got)
+	}
+	if got := fmt.Sprint(fake.markedRead()); got != "[m1]" {
+		t.Errorf("marked read %s, want [m1]", got)
+	}
+}
+
+func TestOCR(t *testing.T) {
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	msg := pdfMessage("m1", date, "a.pdf", "b.pdf")
+	files := &memFiles{}
+	srv := newTestService(files, msg)
+	var mu sync.Mutex
+	var read []string
+	srv.OCR = func(r io.Reader) (string, error) {
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			return "", err
+		}
+		mu.Lock()
+		read = append(read, string(content))
+		mu.Unlock()
+		return "text of " + string(content), nil
+	}
+
+	atts, _, err := srv.processMessages(context.Background(), listed(msg), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(read)
+	if fmt.Sprint(read) != "[%PDF-1.4 m1/a.pdf %PDF-1.4 m1/b.pdf]" {
+		t.Errorf("OCR read %q", read)
+	}
+	if len(atts) != 2 {
+		t.Fatalf("%d attachments, want 2", len(atts))
+	}
+	for _, att := range atts {
+		if want := "text of %PDF-1.4 m1/" + att.OriginalName; att.Text != want {
+			t.Errorf("text of %s = %q, want %q", att.OriginalName, att.Text, want)
+		}
+	}
+
+	t.Run("failing", func(t *testing.T) {
+		files := &memFiles{}
+		srv := newTestService(files, msg)
+		srv.OCR = func(io.Reader) (string, error) { return "", errors.New("unreadable") }
+		atts, _, err := srv.processMessages(context.Background(), listed(msg), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(atts) != 0 || len(files.names()) != 0 || len(srv.Stats.Errors) == 0 {
+			t.Errorf("wrote %v, errors %v", files.names(), srv.Stats.Errors)
+		}
+	})
+}
@@ -0,0 +1,110 @@
+package gmail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/asn1"
+	"errors"
+	"mime"
+	"net/textproto"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// oidSignedData identifies PKCS #7 signed data
+var oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+// errNotSignedData is returned when an S/MIME body isn't signed data, e.g.
+// when it is encrypted
+var errNotSignedData = errors.New("not S/MIME signed data")
+
+// contentInfo is the PKCS #7 ContentInfo wrapping S/MIME bodies
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+// signedData is the PKCS #7 SignedData, of which only the encapsulated
+// content is of interest
+type signedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      contentInfo
+	Rest             asn1.RawValue `asn1:"optional"`
+}
+
+// isSMIME reports whether the part is an opaque S/MIME envelope
+func isSMIME(part *gmail.MessagePart) bool {
+	mimeType := strings.ToLower(part.MimeType)
+	return mimeType == "application/pkcs7-mime" || mimeType == "application/x-pkcs7-mime"
+}
+
+// unwrapSMIME walks the parts of msg looking for S/MIME envelopes, which hide
+// the real attachments. Signed envelopes are opened, when SMIMEUnwrap is set,
+// and their content grafted as the nested part of the envelope. Signatures
+// aren't verified, so no key is needed. Encrypted envelopes, and signed ones
+// that aren't DER encoded, can't be opened and are recorded as unresolved.
+// Parts nested deeper than MaxPartDepth are left alone
+func (srv *Service) unwrapSMIME(msg *gmail.Message, payload *gmail.MessagePart) error {
+	return walkParts(payload, 0, func(part *gmail.MessagePart, depth int) error {
+		if depth > srv.maxPartDepth() {
+			return SkipParts
+		}
+		if !isSMIME(part) {
+			return nil
+		}
+
+		_, params, _ := mime.ParseMediaType(headerValue(part.Headers, "Content-Type"))
+		smimeType := strings.ToLower(params["smime-type"])
+		if smimeType == "enveloped-data" || !srv.SMIMEUnwrap {
+			srv.Stats.recordUnresolved(msg, part, "")
+			return SkipParts
+		}
+
+		body, err := retrieveAttachment(srv.srv, srv.UserID, msg, part.Body)
+		if err != nil {
+			return err
+		}
+		data, err := decodeBody(body, nil)
+		if err != nil {
+			return err
+		}
+		inner, err := parseSignedData(data, part.PartId+".0")
+		if err != nil {
+			// encrypted, or BER encoded which encoding/asn1 can't parse
+			srv.Stats.recordUnresolved(msg, part, "")
+			return SkipParts
+		}
+		part.Parts = []*gmail.MessagePart{inner}
+		return nil
+	})
+}
+
+// parseSignedData extracts the MIME entity signed by a PKCS #7 SignedData
+// structure, converting it to a part with the given ID
+func parseSignedData(data []byte, partID string) (*gmail.MessagePart, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(data, &ci); err != nil {
+		return nil, err
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, errNotSignedData
+	}
+
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, err
+	}
+	var content []byte
+	if _, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &content); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(bytes.NewReader(content))
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	return emlPart(header, r, partID)
+}
@@ -0,0 +1,114 @@
+package gmail
+
+import (
+	"encoding/asn1"
+	"encoding/base64"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// explicit wraps a DER encoded value in the [0] EXPLICIT tag of a ContentInfo
+func explicit(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// signedMessage returns the DER encoding of PKCS #7 signed data, without
+// signers, encapsulating entity
+func signedMessage(t *testing.T, entity string) []byte {
+	data, err := asn1.Marshal([]byte(entity))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, err := asn1.Marshal(signedData{
+		Version:          1,
+		DigestAlgorithms: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true},
+		ContentInfo: contentInfo{
+			ContentType: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1},
+			Content:     explicit(data),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci, err := asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     explicit(sd),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ci
+}
+
+// smimePart returns an opaque signed S/MIME part encapsulating entity
+func smimePart(t *testing.T, partID, entity string) *gmail.MessagePart {
+	der := signedMessage(t, entity)
+	return &gmail.MessagePart{
+		PartId:   partID,
+		MimeType: "application/pkcs7-mime",
+		Filename: "smime.p7m",
+		Headers: []*gmail.MessagePartHeader{
+			{Name: "Content-Type", Value: `application/pkcs7-mime; smime-type=signed-data; name="smime.p7m"`},
+		},
+		Body: &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString(der), Size: int64(len(der))},
+	}
+}
+
+const signedPDF = "Content-Type: application/pdf; name=\"a.pdf\"\r\n" +
+	"Content-Disposition: attachment; filename=\"a.pdf\"\r\n\r\n%PDF-1.4"
+
+func TestParseSignedData(t *testing.T) {
+	part, err := parseSignedData(signedMessage(t, signedPDF), "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part.PartId != "1.0" || part.MimeType != "application/pdf" || part.Filename != "a.pdf" {
+		t.Errorf("part = %s %s %q", part.PartId, part.MimeType, part.Filename)
+	}
+	data, err := decodeBody(part.Body, nil)
+	if err != nil || string(data) != "%PDF-1.4" {
+		t.Errorf("body = %q, %v", data, err)
+	}
+
+	if _, err := parseSignedData([]byte("not der"), "1.0"); err == nil {
+		t.Error("invalid data parsed")
+	}
+}
+
+func TestUnwrapSMIME(t *testing.T) {
+	tests := []struct {
+		name           string
+		unwrap         bool
+		depth          int
+		wantUnwrap     bool
+		wantUnresolved int
+	}{
+		{name: "disabled", depth: 1, wantUnresolved: 1},
+		{name: "unwrapped", unwrap: true, depth: 1, wantUnwrap: true},
+		{name: "too deep", unwrap: true, depth: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := nestedParts(tt.depth - 1)
+			parent := payload
+			for len(parent.Parts) > 0 {
+				parent = parent.Parts[0]
+			}
+			envelope := smimePart(t, "1", signedPDF)
+			parent.Parts = []*gmail.MessagePart{envelope}
+
+			msg := &gmail.Message{Id: "m", Payload: payload}
+			srv := &Service{SMIMEUnwrap: tt.unwrap, MaxPartDepth: 3, Stats: &Stats{}}
+			if err := srv.unwrapSMIME(msg, payload); err != nil {
+				t.Fatal(err)
+			}
+			if unwrapped := len(envelope.Parts) == 1; unwrapped != tt.wantUnwrap {
+				t.Errorf("unwrapped = %t, want %t", unwrapped, tt.wantUnwrap)
+			}
+			if len(srv.Stats.Unresolved) != tt.wantUnresolved {
+				t.Errorf("unresolved = %v", srv.Stats.Unresolved)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package gmail
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxDateSkew is how far the Date header may be ahead of when Gmail received
+// a message before it is considered wrong
+const maxDateSkew = 24 * time.Hour
+
+// SortByDate orders the attachments by the time Gmail received their message,
+// oldest first. Attachments of the same message keep their order
+func (at ProcessedAttachments) SortByDate() {
+	sort.SliceStable(at, func(i, j int) bool {
+		return at[i].InternalDate.Before(at[j].InternalDate)
+	})
+}
+
+// GroupByMimeType splits the attachments by their lower cased MIME type,
+// without parameters. Attachments keep their order within each group
+func (at ProcessedAttachments) GroupByMimeType() map[string]ProcessedAttachments {
+	groups := make(map[string]ProcessedAttachments)
+	for _, att := range at {
+		mimeType := strings.ToLower(strings.TrimSpace(att.MimeType))
+		if i := strings.IndexByte(mimeType, ';'); i >= 0 {
+			mimeType = strings.TrimSpace(mimeType[:i])
+		}
+		groups[mimeType] = append(groups[mimeType], att)
+	}
+	return groups
+}
+
+// Paths returns where the attachments were written, leaving out those that
+// weren't written to files
+func (at ProcessedAttachments) Paths() []string {
+	paths := make([]string, 0, len(at))
+	for _, att := range at {
+		if att.Path != "" {
+			paths = append(paths, att.Path)
+		}
+	}
+	return paths
+}
+
+// partitionDate returns the Date of the message unless it is missing or
+// clearly wrong, in which case the InternalDate is used
+func (a *ProcessedAttachment) partitionDate() time.Time {
+	if a.Date.IsZero() {
+		return a.InternalDate
+	}
+	if !a.InternalDate.IsZero() && a.Date.Sub(a.InternalDate) > maxDateSkew {
+		return a.InternalDate
+	}
+	return a.Date
+}
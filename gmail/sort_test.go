@@ -0,0 +1,54 @@
+package gmail
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPartitionDate(t *testing.T) {
+	received := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		date time.Time
+		want time.Time
+	}{
+		{name: "no date", want: received},
+		{name: "date", date: received.Add(-time.Hour), want: received.Add(-time.Hour)},
+		{name: "slightly ahead", date: received.Add(time.Hour), want: received.Add(time.Hour)},
+		{name: "far ahead", date: received.Add(48 * time.Hour), want: received},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			att := &ProcessedAttachment{Date: tt.date, InternalDate: received}
+			if got := att.partitionDate(); !got.Equal(tt.want) {
+				t.Errorf("partitionDate = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSortAndGroup(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC) }
+	at := ProcessedAttachments{
+		{Filename: "c", InternalDate: day(3), MimeType: "application/PDF"},
+		{Filename: "a1", InternalDate: day(1), MimeType: "image/png; name=a1", Path: "out/a1"},
+		{Filename: "a2", InternalDate: day(1), MimeType: "application/pdf", Path: "out/a2"},
+	}
+	at.SortByDate()
+	var names []string
+	for _, att := range at {
+		names = append(names, att.Filename)
+	}
+	if want := []string{"a1", "a2", "c"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("sorted %v, want %v", names, want)
+	}
+
+	groups := at.GroupByMimeType()
+	if len(groups) != 2 || len(groups["application/pdf"]) != 2 || len(groups["image/png"]) != 1 {
+		t.Errorf("groups = %v", groups)
+	}
+	if want := []string{"out/a1", "out/a2"}; !reflect.DeepEqual(at.Paths(), want) {
+		t.Errorf("paths = %v, want %v", at.Paths(), want)
+	}
+}
@@ -0,0 +1,202 @@
+package gmail
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Stats summarises the outcome of a ProcessPDFAttachments run
+type Stats struct {
+	// RunID identifies the run, see Service.RunID
+	RunID string
+	// Messages is the number of messages whose attachments were all processed
+	Messages int
+	// Attachments is the number of attachments successfully processed
+	Attachments int
+	// SkippedTooSmall counts attachments below Service.MinAttachmentBytes
+	SkippedTooSmall int
+	// SkippedNotNewer counts attachments skipped by the IfNewer overwrite
+	// policy
+	SkippedNotNewer int
+	// Quarantined counts attachments rejected by Service.Scan
+	Quarantined int
+	// AttachmentCacheHits counts attachments referenced by more than one
+	// part of a message that were reused instead of retrieved again
+	AttachmentCacheHits int
+	// UnmatchedAttachments counts attachments skipped because their MIME
+	// type or filename isn't accepted
+	UnmatchedAttachments int
+	// HadUnmatchedAttachments lists the IDs of messages that had attachments
+	// but none matching the accepted MIME types or FilenameRegex, a hint that
+	// the filter may be wrong
+	HadUnmatchedAttachments []string
+	// TooDeep lists the IDs of messages with parts nested beyond
+	// Service.MaxPartDepth, which were ignored
+	TooDeep []string
+	// SkippedLabels counts messages skipped for lacking a label of
+	// Service.RequireLabelIDs
+	SkippedLabels int
+	// InvalidMessages counts listed messages skipped for lacking an ID
+	InvalidMessages int
+	// Vanished lists the IDs of messages deleted between being listed and
+	// being retrieved
+	Vanished []string
+	// Unresolved lists parts referencing their content by Content-Location,
+	// which isn't retrieved, and S/MIME envelopes that couldn't be opened
+	Unresolved []UnresolvedPart
+	// Fetch aggregates the time taken to retrieve attachments from Gmail
+	Fetch DurationStats
+	// Decode aggregates the time taken to decode attachment bodies
+	Decode DurationStats
+	// Errors holds the errors that were recorded without aborting the run
+	Errors []*AttachmentError
+
+	// names holds the filenames used in the run, see Service.Dedup
+	names map[string]bool
+
+	// mu guards counters updated while messages are retrieved concurrently
+	mu sync.Mutex
+}
+
+// DurationStats aggregates observed durations
+type DurationStats struct {
+	Min   time.Duration
+	Max   time.Duration
+	Total time.Duration
+	Count int
+}
+
+// Avg returns the mean of the observed durations
+func (ds DurationStats) Avg() time.Duration {
+	if ds.Count == 0 {
+		return 0
+	}
+	return ds.Total / time.Duration(ds.Count)
+}
+
+func (ds *DurationStats) observe(d time.Duration) {
+	if ds.Count == 0 || d < ds.Min {
+		ds.Min = d
+	}
+	if d > ds.Max {
+		ds.Max = d
+	}
+	ds.Total += d
+	ds.Count++
+}
+
+// UnresolvedPart is a message part whose content lives elsewhere
+type UnresolvedPart struct {
+	MessageID string
+	PartID    string
+	MimeType  string
+	// Location is the value of the Content-Location header, empty for
+	// S/MIME envelopes
+	Location string
+}
+
+// AttachmentError describes a failure to process a single message part
+type AttachmentError struct {
+	MessageID string
+	PartID    string
+	Filename  string
+	Err       error
+}
+
+func (e *AttachmentError) Error() string {
+	return fmt.Sprintf("message %s part %s (%s): %s", e.MessageID, e.PartID, e.Filename, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *AttachmentError) Unwrap() error {
+	return e.Err
+}
+
+// incr increments a counter of st, which may be updated concurrently
+func (st *Stats) incr(counter *int) {
+	st.mu.Lock()
+	*counter++
+	st.mu.Unlock()
+}
+
+func (st *Stats) recordError(msg *gmail.Message, part *gmail.MessagePart, err error) *AttachmentError {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	attErr := &AttachmentError{
+		MessageID: msg.Id,
+		PartID:    part.PartId,
+		Filename:  part.Filename,
+		Err:       err,
+	}
+	st.Errors = append(st.Errors, attErr)
+	return attErr
+}
+
+func (st *Stats) recordUnresolved(msg *gmail.Message, part *gmail.MessagePart, location string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.Unresolved = append(st.Unresolved, UnresolvedPart{
+		MessageID: msg.Id,
+		PartID:    part.PartId,
+		MimeType:  part.MimeType,
+		Location:  location,
+	})
+}
+
+// resetStats starts the Stats of a new run, identified by RunID or a random
+// one
+func (srv *Service) resetStats() error {
+	srv.Stats = &Stats{RunID: srv.RunID}
+	if srv.Stats.RunID == "" {
+		var err error
+		if srv.Stats.RunID, err = newRunID(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newRunID returns a random (version 4) UUID
+func newRunID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+func (st *Stats) recordUnmatched(msg *gmail.Message, unmatched int, noneMatched bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.UnmatchedAttachments += unmatched
+	if noneMatched {
+		st.HadUnmatchedAttachments = append(st.HadUnmatchedAttachments, msg.Id)
+	}
+}
+
+func (st *Stats) recordTooDeep(msg *gmail.Message) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.TooDeep = append(st.TooDeep, msg.Id)
+}
+
+// claimName records name as used in the run, reporting false if it already
+// was
+func (st *Stats) claimName(name string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.names[name] {
+		return false
+	}
+	if st.names == nil {
+		st.names = make(map[string]bool)
+	}
+	st.names[name] = true
+	return true
+}
@@ -0,0 +1,57 @@
+package gmail
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+)
+
+// TunedHTTPClient returns a client authorised by ts whose transport keeps up
+// to maxConns connections to Gmail open, rather than the 2 idle connections
+// per host of http.DefaultTransport. Set maxConns to at least Concurrency, or
+// to Concurrency times MailboxConcurrency when processing several mailboxes.
+// Use it with NewHTTPClientService
+func TunedHTTPClient(ts oauth2.TokenSource, maxConns int) *http.Client {
+	return &http.Client{Transport: &oauth2.Transport{
+		Source: oauth2.ReuseTokenSource(nil, ts),
+		Base:   tunedTransport(maxConns),
+	}}
+}
+
+// tunedTransport is http.DefaultTransport with its connection limits raised
+// to maxConns
+func tunedTransport(maxConns int) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          maxConns,
+		MaxIdleConnsPerHost:   maxConns,
+		MaxConnsPerHost:       maxConns,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// NewHTTPClientService creates a service acting as userID whose requests are
+// sent, and authorised, by client, e.g. one returned by TunedHTTPClient.
+// Requests rejected as unauthorised aren't retried with a new token, and
+// features relying on delegation, such as ForUser, aren't available. See
+// NewService for opts
+func NewHTTPClientService(client *http.Client, userID string, opts ...option.ClientOption) (*Service, error) {
+	gmailSrv, client, err := newClientService(client, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &Service{UserID: userID, opts: opts}
+	srv.setDefaults(gmailSrv, client)
+	return srv, nil
+}
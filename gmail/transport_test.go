@@ -0,0 +1,81 @@
+package gmail
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+)
+
+func TestNewHTTPClientServiceUserAgent(t *testing.T) {
+	var agents []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents = append(agents, r.UserAgent())
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name string
+		opts []option.ClientOption
+		want string
+	}{
+		{name: "default", want: DefaultAppName},
+		{name: "app name", opts: []option.ClientOption{option.WithUserAgent("reports/1.0")}, want: "reports/1.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agents = nil
+			opts := append([]option.ClientOption{option.WithEndpoint(ts.URL + "/gmail/v1/users/")}, tt.opts...)
+			srv, err := NewHTTPClientService(ts.Client(), "me", opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := srv.ListMessagesContext(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if len(agents) != 1 || !strings.Contains(agents[0], tt.want) {
+				t.Errorf("user agents %q, want %q", agents, tt.want)
+			}
+		})
+	}
+}
+
+func TestTunedHTTPClient(t *testing.T) {
+	var auths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auths = append(auths, r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	client := TunedHTTPClient(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"}), 16)
+	auth, ok := client.Transport.(*oauth2.Transport)
+	if !ok {
+		t.Fatalf("transport %T, want *oauth2.Transport", client.Transport)
+	}
+	base, ok := auth.Base.(*http.Transport)
+	if !ok {
+		t.Fatalf("base transport %T, want *http.Transport", auth.Base)
+	}
+	if base.MaxIdleConns != 16 || base.MaxIdleConnsPerHost != 16 || base.MaxConnsPerHost != 16 {
+		t.Errorf("max idle %d, per host %d, idle per host %d, want 16", base.MaxIdleConns, base.MaxConnsPerHost, base.MaxIdleConnsPerHost)
+	}
+
+	srv, err := NewHTTPClientService(client, "me", option.WithEndpoint(ts.URL+"/gmail/v1/users/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.ListMessagesContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(auths) != 1 || auths[0] != "Bearer token" {
+		t.Errorf("authorization %q, want the token of the source", auths)
+	}
+}
@@ -0,0 +1,57 @@
+package gmail
+
+import (
+	"errors"
+	"strconv"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// SkipParts is returned by a WalkParts visitor to skip the parts nested in
+// the part being visited. It isn't returned by WalkParts
+var SkipParts = errors.New("skip nested parts")
+
+// WalkParts visits every part of the message depth first, parents before
+// their nested parts, starting with the payload at depth 0. Walking stops at
+// the first error returned by visit, other than SkipParts, which WalkParts
+// returns
+func (srv *Service) WalkParts(msg *gmail.Message, visit func(part *gmail.MessagePart, depth int) error) error {
+	if msg.Payload == nil {
+		return nil
+	}
+	return walkParts(msg.Payload, 0, visit)
+}
+
+func walkParts(part *gmail.MessagePart, depth int, visit func(part *gmail.MessagePart, depth int) error) error {
+	if err := visit(part, depth); err != nil {
+		if err == SkipParts {
+			return nil
+		}
+		return err
+	}
+	for _, p := range part.Parts {
+		if err := walkParts(p, depth+1, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// disambiguatePartIDs renames parts repeating the ID of an earlier part, as
+// seen in malformed messages, by appending a counter e.g. 1-2, so names
+// derived from part IDs don't collide. Parts nested deeper than maxDepth are
+// left alone
+func disambiguatePartIDs(payload *gmail.MessagePart, maxDepth int) {
+	seen := make(map[string]int)
+	walkParts(payload, 0, func(part *gmail.MessagePart, depth int) error {
+		if depth > maxDepth {
+			return SkipParts
+		}
+		n := seen[part.PartId]
+		seen[part.PartId] = n + 1
+		if n > 0 {
+			part.PartId += "-" + strconv.Itoa(n+1)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,61 @@
+package gmail
+
+import (
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// nestedParts returns a payload with parts nested depth levels deep, all of
+// them with the same ID
+func nestedParts(depth int) *gmail.MessagePart {
+	payload := &gmail.MessagePart{PartId: "0"}
+	part := payload
+	for i := 0; i < depth; i++ {
+		child := &gmail.MessagePart{PartId: "0"}
+		part.Parts = []*gmail.MessagePart{child}
+		part = child
+	}
+	return payload
+}
+
+func TestWalkPartsSkip(t *testing.T) {
+	payload := &gmail.MessagePart{PartId: "", Parts: []*gmail.MessagePart{
+		{PartId: "0", Parts: []*gmail.MessagePart{{PartId: "0.0"}}},
+		{PartId: "1", Parts: []*gmail.MessagePart{{PartId: "1.0"}}},
+	}}
+	var visited []string
+	walkParts(payload, 0, func(part *gmail.MessagePart, depth int) error {
+		visited = append(visited, part.PartId)
+		if part.PartId == "0" {
+			return SkipParts
+		}
+		return nil
+	})
+	if got, want := len(visited), 4; got != want {
+		t.Fatalf("visited %v", visited)
+	}
+	for i, want := range []string{"", "0", "1", "1.0"} {
+		if visited[i] != want {
+			t.Errorf("visited %v", visited)
+			break
+		}
+	}
+}
+
+func TestDisambiguatePartIDs(t *testing.T) {
+	payload := nestedParts(5)
+	disambiguatePartIDs(payload, 3)
+
+	var ids []string
+	walkParts(payload, 0, func(part *gmail.MessagePart, depth int) error {
+		ids = append(ids, part.PartId)
+		return nil
+	})
+	want := []string{"0", "0-2", "0-3", "0-4", "0", "0"}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Fatalf("part IDs = %v, want %v", ids, want)
+		}
+	}
+}
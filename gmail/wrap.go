@@ -0,0 +1,50 @@
+package gmail
+
+import (
+	"io"
+)
+
+// wrapWriter returns w extended with the Read, Seek and Close methods of
+// inner, so decorating a generator's writer doesn't hide capabilities callers
+// rely on such as reading back a file. A non nil closer replaces inner's Close
+func wrapWriter(inner io.Writer, w io.Writer, closer io.Closer) io.Writer {
+	r, isReader := inner.(io.Reader)
+	c, isCloser := inner.(io.Closer)
+	s, isSeeker := inner.(io.Seeker)
+	if closer != nil {
+		c, isCloser = closer, true
+	}
+
+	switch {
+	case isReader && isSeeker && isCloser:
+		return struct {
+			io.Writer
+			io.Reader
+			io.Seeker
+			io.Closer
+		}{w, r, s, c}
+	case isReader && isSeeker:
+		return struct {
+			io.Writer
+			io.Reader
+			io.Seeker
+		}{w, r, s}
+	case isReader && isCloser:
+		return struct {
+			io.Writer
+			io.Reader
+			io.Closer
+		}{w, r, c}
+	case isReader:
+		return struct {
+			io.Writer
+			io.Reader
+		}{w, r}
+	case isCloser:
+		return struct {
+			io.Writer
+			io.Closer
+		}{w, c}
+	}
+	return struct{ io.Writer }{w}
+}